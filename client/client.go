@@ -0,0 +1,202 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 17:12:37
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 17:12:37
+ * @FilePath: /raycast2api/client/client.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+// Package client is a typed Go client for the Raycast2API proxy
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/missuo/raycast2api/service"
+)
+
+// Client talks to a Raycast2API server
+type Client struct {
+	BaseURL    string       // e.g. "http://localhost:8080/v1"
+	APIKey     string       // Sent as a bearer token, empty sends none
+	HTTPClient *http.Client // Defaults to http.DefaultClient
+}
+
+// Stream receives the chunks of a streaming chat completion
+type Stream struct {
+	Chunks <-chan service.OpenAIChatChunk // Closed when the stream ends
+	err    error
+	body   io.ReadCloser
+}
+
+// APIError is returned when the server responds with an error status, or ends a stream
+// that has already started with an error event, in which case StatusCode is 0
+type APIError struct {
+	StatusCode int
+	Message    string
+	Type       string
+	Details    string
+}
+
+func (e *APIError) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("%s (%d %s): %s", e.Message, e.StatusCode, e.Type, e.Details)
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Type)
+}
+
+// New creates a client for the server at baseURL, including the /v1 prefix
+func New(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// ChatCompletion creates a non-streaming chat completion
+func (c *Client) ChatCompletion(ctx context.Context, req service.OpenAIChatRequest) (*service.OpenAIChatResponse, error) {
+	req.Stream = false
+	resp, err := c.postChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var completion service.OpenAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return nil, fmt.Errorf("error decoding chat completion: %w", err)
+	}
+	return &completion, nil
+}
+
+// ChatCompletionStream creates a streaming chat completion. Chunks are delivered on the
+// returned stream until it ends, the server fails, or ctx is cancelled; check Err afterwards.
+func (c *Client) ChatCompletionStream(ctx context.Context, req service.OpenAIChatRequest) (*Stream, error) {
+	req.Stream = true
+	resp, err := c.postChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(chan service.OpenAIChatChunk)
+	stream := &Stream{Chunks: chunks, body: resp.Body}
+	go stream.read(ctx, chunks)
+	return stream, nil
+}
+
+// Err returns the error that ended the stream, if any. Only valid once Chunks is closed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close stops reading the stream early
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// read decodes SSE events from the response body into chunks
+func (s *Stream) read(ctx context.Context, chunks chan<- service.OpenAIChatChunk) {
+	defer close(chunks)
+	defer s.body.Close()
+
+	scanner := bufio.NewScanner(s.body)
+	scanner.Buffer(make([]byte, 0, 64<<10), service.MaxSSELineBytes)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Skip blank lines and comments such as keepalives
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return
+		}
+
+		// Errors after the stream has started arrive as an error event instead of a status
+		var errorResponse service.ErrorResponse
+		if err := json.Unmarshal([]byte(data), &errorResponse); err == nil && errorResponse.Error.Message != "" {
+			s.err = &APIError{
+				Message: errorResponse.Error.Message,
+				Type:    errorResponse.Error.Type,
+				Details: errorResponse.Error.Details,
+			}
+			return
+		}
+
+		var chunk service.OpenAIChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			s.err = fmt.Errorf("error decoding chunk: %w", err)
+			return
+		}
+
+		select {
+		case chunks <- chunk:
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		s.err = err
+		return
+	}
+	s.err = io.ErrUnexpectedEOF // The server always ends with [DONE]
+}
+
+// postChatCompletion sends a chat completion request and turns error statuses into an APIError
+func (c *Client) postChatCompletion(ctx context.Context, req service.OpenAIChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	if c.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+
+		var errorResponse service.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err == nil && errorResponse.Error.Message != "" {
+			apiErr.Message = errorResponse.Error.Message
+			apiErr.Type = errorResponse.Error.Type
+			apiErr.Details = errorResponse.Error.Details
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/missuo/raycast2api/service"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestServer starts a Raycast2API server backed by a fake Raycast API whose chat requests are passed to chat
+func newTestServer(t *testing.T, configure func(config *service.Config), chat func(w http.ResponseWriter)) *Client {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"models":[{"model":"gpt-4o","provider":"openai","context":128000}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		chat(w)
+	}))
+	t.Cleanup(upstream.Close)
+
+	config := service.Config{
+		RaycastBearerToken: "test-token",
+		APIURLs:            []string{upstream.URL},
+		ModelsURLs:         []string{upstream.URL + "/models"},
+		ModelCache:         service.NewModelCache(),
+		ModelCacheTTL:      time.Hour,
+		HTTPClient:         &http.Client{},
+		ModelsClient:       &http.Client{Timeout: time.Second},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	server := httptest.NewServer(service.Router(&config))
+	t.Cleanup(server.Close)
+	return New(server.URL+"/v1", "")
+}
+
+// writeEvents writes Raycast SSE events, each value encoded as one data line
+func writeEvents(w http.ResponseWriter, events ...service.RaycastSSEData) {
+	for _, event := range events {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+}
+
+// testRequest is a chat request for the fake upstream's only model
+var testRequest = service.OpenAIChatRequest{
+	Model:    "gpt-4o",
+	Messages: []service.OpenAIMessage{{Role: "user", Content: "Hi"}},
+}
+
+func TestChatCompletion(t *testing.T) {
+	client := newTestServer(t, nil, func(w http.ResponseWriter) {
+		writeEvents(w, service.RaycastSSEData{Text: "Hello"}, service.RaycastSSEData{Text: " there"}, service.RaycastSSEData{FinishReason: "stop"})
+	})
+
+	completion, err := client.ChatCompletion(context.Background(), testRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "Hello there" {
+		t.Fatalf("unexpected completion: %+v", completion)
+	}
+}
+
+func TestChatCompletionAPIError(t *testing.T) {
+	client := newTestServer(t, nil, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	_, err := client.ChatCompletion(context.Background(), testRequest)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Type != "relay_error" {
+		t.Fatalf("expected a 502 relay_error, got %v", err)
+	}
+}
+
+// collect reads a stream to its end and returns the streamed content
+func collect(stream *Stream) string {
+	var text strings.Builder
+	for chunk := range stream.Chunks {
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Delta.Content)
+		}
+	}
+	return text.String()
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	client := newTestServer(t, nil, func(w http.ResponseWriter) {
+		writeEvents(w, service.RaycastSSEData{Text: "Hello"}, service.RaycastSSEData{Text: " there"}, service.RaycastSSEData{FinishReason: "stop"})
+	})
+
+	stream, err := client.ChatCompletionStream(context.Background(), testRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := collect(stream); text != "Hello there" {
+		t.Fatalf("expected %q, got %q", "Hello there", text)
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+}
+
+func TestChatCompletionStreamErrorEvent(t *testing.T) {
+	// With queue feedback the stream starts while waiting for a slot, so a failed upstream request is reported mid-stream
+	var limiter *service.UpstreamLimiter
+	client := newTestServer(t, func(config *service.Config) {
+		limiter = service.NewUpstreamLimiter(1, false)
+		config.UpstreamLimiter = limiter
+		config.QueueFeedback = true
+	}, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	limiter.Acquire(context.Background(), nil)
+	stream, err := client.ChatCompletionStream(context.Background(), testRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.Release()
+
+	if text := collect(stream); text != "" {
+		t.Fatalf("expected no content, got %q", text)
+	}
+	var apiErr *APIError
+	if !errors.As(stream.Err(), &apiErr) || apiErr.StatusCode != 0 || apiErr.Type != "relay_error" {
+		t.Fatalf("expected the error event as an APIError, got %v", stream.Err())
+	}
+}
+
+func TestChatCompletionStreamErrorAfterContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"Hel"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"error":{"message":"Raycast API error: 500 Internal Server Error","type":"relay_error"}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	stream, err := New(server.URL, "").ChatCompletionStream(context.Background(), testRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := collect(stream); text != "Hel" {
+		t.Fatalf("expected the content before the error, got %q", text)
+	}
+	var apiErr *APIError
+	if !errors.As(stream.Err(), &apiErr) || apiErr.Message != "Raycast API error: 500 Internal Server Error" {
+		t.Fatalf("expected the error event as an APIError, got %v", stream.Err())
+	}
+}
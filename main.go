@@ -13,7 +13,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/missuo/raycast2api/service"
@@ -21,13 +26,28 @@ import (
 
 // Main function
 func main() {
-	config := service.InitConfig()
+	configFile := flag.String("config", "", "Path to a YAML or JSON config file")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	flag.Parse()
+
+	if *showVersion {
+		info := service.BuildInfo()
+		fmt.Printf("raycast2api %s (commit %s, built %s)\n", info.Version, info.Commit, info.Date)
+		return
+	}
+
+	config := service.InitConfig(*configFile)
 
 	fmt.Printf("Raycast2API has been successfully launched! Listening on %v\n", config.Port)
 
 	// Set Release Mode
 	gin.SetMode(gin.ReleaseMode)
 
-	app := service.Router(config)
-	app.Run(fmt.Sprintf(":%v", config.Port))
+	// Stop gracefully on Ctrl+C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := service.Run(ctx, config); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,90 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 11:05:18
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 11:05:18
+ * @FilePath: /raycast2api/service/audit.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditLogger appends one JSON line per completion to an audit file
+type AuditLogger struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// AuditEntry represents a single audit log line. It never contains message content.
+type AuditEntry struct {
+	Timestamp        string            `json:"timestamp"`
+	KeyFingerprint   string            `json:"key_fingerprint,omitempty"`
+	Model            string            `json:"model"`
+	PromptTokens     int               `json:"prompt_tokens"`
+	CompletionTokens int               `json:"completion_tokens"`
+	FinishReason     string            `json:"finish_reason"`
+	Cached           bool              `json:"cached,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"` // Client-supplied tags from the request
+}
+
+// NewAuditLogger opens the audit file for appending
+func NewAuditLogger(path string) (*AuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+	return &AuditLogger{file: file}, nil
+}
+
+// Log records a completion. It is a no-op when auditing is disabled.
+func (al *AuditLogger) Log(c *gin.Context, model string, promptTokens int, completionTokens int, finishReason string, cached bool, metadata map[string]string) {
+	if al == nil {
+		return
+	}
+
+	line, err := json.Marshal(AuditEntry{
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		KeyFingerprint:   keyFingerprint(c.GetString(apiKeyKey)),
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		FinishReason:     finishReason,
+		Cached:           cached,
+		Metadata:         metadata,
+	})
+	if err != nil {
+		log.Printf("Error marshaling audit entry: %v", err)
+		return
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// keyFingerprint returns a short hash identifying an API key without revealing it
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])[:16]
+}
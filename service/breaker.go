@@ -0,0 +1,132 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 12:20:37
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 12:20:37
+ * @FilePath: /raycast2api/service/breaker.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the circuit breaker is rejecting upstream requests
+var ErrCircuitOpen = errors.New("raycast upstream is unavailable, circuit breaker is open")
+
+// CircuitBreaker stops sending requests to Raycast after repeated failures.
+// After threshold consecutive failures within window, the breaker opens and
+// rejects requests for cooldown. It then half-opens and lets a single probe
+// through: success closes the breaker, failure opens it again.
+type CircuitBreaker struct {
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	open         bool
+	probing      bool
+	mutex        sync.Mutex
+}
+
+// NewCircuitBreaker creates a new circuit breaker
+func NewCircuitBreaker(threshold int, window time.Duration, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a request may be sent upstream. A nil breaker allows everything.
+func (cb *CircuitBreaker) Allow() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.open {
+		return true
+	}
+	if cb.probing || time.Since(cb.openedAt) < cb.cooldown {
+		return false
+	}
+
+	// Cooldown is over, let a single probe through
+	cb.probing = true
+	log.Println("Circuit breaker half-open, probing Raycast")
+	return true
+}
+
+// RecordSuccess closes the breaker and resets the failure count
+func (cb *CircuitBreaker) RecordSuccess() {
+	if cb == nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.open {
+		log.Println("Circuit breaker closed, Raycast recovered")
+	}
+	cb.failures = 0
+	cb.open = false
+	cb.probing = false
+}
+
+// RecordCanceled ends a request that was cancelled by its client without counting it either way.
+// A cancelled probe lets the next request probe instead.
+func (cb *CircuitBreaker) RecordCanceled() {
+	if cb == nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.probing = false
+}
+
+// RecordFailure counts a failure and opens the breaker once the threshold is reached
+func (cb *CircuitBreaker) RecordFailure() {
+	if cb == nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+
+	// A failed probe reopens the breaker for another cooldown
+	if cb.probing {
+		cb.probing = false
+		cb.openedAt = now
+		log.Printf("Circuit breaker probe failed, open for another %v", cb.cooldown)
+		return
+	}
+
+	// Start counting again when the previous failures fall outside the window
+	if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+
+	if !cb.open && cb.failures >= cb.threshold {
+		cb.open = true
+		cb.openedAt = now
+		log.Printf("Circuit breaker open after %d consecutive failures, rejecting requests for %v", cb.failures, cb.cooldown)
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		cb.RecordFailure()
+		if !cb.Allow() {
+			t.Fatalf("breaker opened after %d failures, threshold is 3", i+1)
+		}
+	}
+	cb.RecordFailure()
+	if cb.Allow() {
+		t.Fatal("breaker still closed after reaching the threshold")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute, time.Hour)
+
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+	if !cb.Allow() {
+		t.Fatal("failures before a success were still counted")
+	}
+}
+
+func TestCircuitBreakerWindowExpires(t *testing.T) {
+	cb := NewCircuitBreaker(2, 20*time.Millisecond, time.Hour)
+
+	cb.RecordFailure()
+	time.Sleep(40 * time.Millisecond)
+	cb.RecordFailure()
+	if !cb.Allow() {
+		t.Fatal("a failure outside the window was counted")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute, 20*time.Millisecond)
+
+	cb.RecordFailure()
+	if cb.Allow() {
+		t.Fatal("breaker allowed a request while open")
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	if !cb.Allow() {
+		t.Fatal("breaker did not let a probe through after the cooldown")
+	}
+	if cb.Allow() {
+		t.Fatal("breaker let a second request through while probing")
+	}
+
+	// A failed probe opens the breaker for another cooldown
+	cb.RecordFailure()
+	if cb.Allow() {
+		t.Fatal("breaker allowed a request right after a failed probe")
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	// A successful probe closes it
+	if !cb.Allow() {
+		t.Fatal("breaker did not probe again after the second cooldown")
+	}
+	cb.RecordSuccess()
+	for i := 0; i < 3; i++ {
+		if !cb.Allow() {
+			t.Fatal("breaker rejected a request after a successful probe")
+		}
+	}
+}
+
+func TestNilCircuitBreakerAllows(t *testing.T) {
+	var cb *CircuitBreaker
+	cb.RecordFailure()
+	if !cb.Allow() {
+		t.Fatal("nil breaker rejected a request")
+	}
+}
+
+// A probe turned away by a full concurrency limit must not leave the breaker stuck half-open
+func TestCircuitBreakerProbeRejectedByLimiter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig(upstream.URL)
+	config.CircuitBreaker = NewCircuitBreaker(1, time.Minute, 20*time.Millisecond)
+	config.UpstreamLimiter = NewUpstreamLimiter(1, true)
+
+	config.CircuitBreaker.RecordFailure()
+	time.Sleep(40 * time.Millisecond)
+
+	// Fill the only slot, so the next request is rejected as busy
+	if !config.UpstreamLimiter.Acquire(context.Background(), nil) {
+		t.Fatal("could not take the limiter slot")
+	}
+	if _, err := sendRaycastRequest(context.Background(), config, RaycastChatRequest{Model: "gpt-4o"}, nil); !errors.Is(err, ErrUpstreamBusy) {
+		t.Fatalf("expected ErrUpstreamBusy, got %v", err)
+	}
+	config.UpstreamLimiter.Release()
+
+	resp, err := sendRaycastRequest(context.Background(), config, RaycastChatRequest{Model: "gpt-4o"}, nil)
+	if err != nil {
+		t.Fatalf("probe after the busy rejection failed: %v", err)
+	}
+	resp.Body.Close()
+	if !config.CircuitBreaker.Allow() {
+		t.Fatal("breaker did not close after a successful probe")
+	}
+}
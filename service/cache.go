@@ -0,0 +1,103 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 10:12:40
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 10:12:40
+ * @FilePath: /raycast2api/service/cache.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// ResponseCache represents an in-memory LRU cache of assembled completions
+type ResponseCache struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // Front is the most recently used entry
+	mutex    sync.Mutex
+}
+
+// responseCacheItem stores a single cached completion
+type responseCacheItem struct {
+	key        string
+	completion CachedCompletion
+}
+
+// CachedCompletion is a finished completion as returned to the client
+type CachedCompletion struct {
+	Text         string
+	Reasoning    string // Empty unless the request asked for reasoning
+	Annotations  []Annotation
+	FinishReason string
+}
+
+// NewResponseCache creates a new response cache holding at most capacity entries
+func NewResponseCache(capacity int) *ResponseCache {
+	return &ResponseCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the cached completion for a key and marks it as recently used
+func (rc *ResponseCache) Get(key string) (CachedCompletion, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	element, ok := rc.entries[key]
+	if !ok {
+		return CachedCompletion{}, false
+	}
+	rc.order.MoveToFront(element)
+	return element.Value.(*responseCacheItem).completion, true
+}
+
+// Set stores a completion, evicting the least recently used entry when full
+func (rc *ResponseCache) Set(key string, completion CachedCompletion) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if element, ok := rc.entries[key]; ok {
+		element.Value.(*responseCacheItem).completion = completion
+		rc.order.MoveToFront(element)
+		return
+	}
+
+	rc.entries[key] = rc.order.PushFront(&responseCacheItem{key: key, completion: completion})
+
+	if rc.order.Len() > rc.capacity {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*responseCacheItem).key)
+	}
+}
+
+// responseCacheKey builds a cache key from the upstream request, which carries the model, provider, messages,
+// instructions and sampling parameters, and from the request options applied to the response by the proxy
+func responseCacheKey(raycastRequest RaycastChatRequest, body OpenAIChatRequest) string {
+	raycastRequest.ThreadID = "" // A fresh thread ID is generated for every request
+	keyData, _ := json.Marshal(struct {
+		Request          RaycastChatRequest `json:"request"`
+		ResponseFormat   *ResponseFormat    `json:"response_format"`
+		IncludeReasoning bool               `json:"include_reasoning"`
+	}{
+		Request:          raycastRequest,
+		ResponseFormat:   body.ResponseFormat,
+		IncludeReasoning: body.IncludeReasoning,
+	})
+
+	hash := sha256.Sum256(keyData)
+	return hex.EncodeToString(hash[:])
+}
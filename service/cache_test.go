@@ -0,0 +1,117 @@
+package service
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rc := NewResponseCache(2)
+	rc.Set("a", CachedCompletion{Text: "A"})
+	rc.Set("b", CachedCompletion{Text: "B"})
+	rc.Get("a")
+	rc.Set("c", CachedCompletion{Text: "C"})
+
+	if _, ok := rc.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if cached, ok := rc.Get("a"); !ok || cached.Text != "A" {
+		t.Errorf("recently used entry was evicted, got %+v", cached)
+	}
+	if cached, ok := rc.Get("c"); !ok || cached.Text != "C" {
+		t.Errorf("newest entry missing, got %+v", cached)
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	seed := int64(7)
+	message := RaycastMessage{Author: "user"}
+	message.Content.Text = "Hello"
+	base := RaycastChatRequest{
+		Model:       "gpt-4o",
+		Provider:    "openai",
+		Messages:    []RaycastMessage{message},
+		Temperature: 0.5,
+		ThreadID:    "thread-1",
+	}
+	baseKey := responseCacheKey(base, OpenAIChatRequest{})
+
+	sameThread := base
+	sameThread.ThreadID = "thread-2"
+	if responseCacheKey(sameThread, OpenAIChatRequest{}) != baseKey {
+		t.Error("thread ID changed the cache key")
+	}
+
+	variants := map[string]func(*RaycastChatRequest, *OpenAIChatRequest){
+		"model":                   func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Model = "gpt-4o-mini" },
+		"provider":                func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Provider = "azure_openai" },
+		"messages":                func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Messages = nil },
+		"system instruction":      func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.SystemInstruction = "Be brief" },
+		"additional instructions": func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.AdditionalSystemInstructions = "Use French" },
+		"temperature":             func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Temperature = 1 },
+		"max_tokens":              func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.MaxTokens = 100 },
+		"seed":                    func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Seed = &seed },
+		"logit_bias":              func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.LogitBias = map[string]float64{"1": 5} },
+		"reasoning_effort":        func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.ReasoningEffort = "high" },
+		"thinking":                func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Thinking = &ThinkingConfig{Type: "enabled"} },
+		"tools":                   func(r *RaycastChatRequest, b *OpenAIChatRequest) { r.Tools = []RaycastTool{{Name: "web_search"}} },
+		"response_format": func(r *RaycastChatRequest, b *OpenAIChatRequest) {
+			b.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		},
+		"include_reasoning": func(r *RaycastChatRequest, b *OpenAIChatRequest) { b.IncludeReasoning = true },
+	}
+	for name, vary := range variants {
+		request, body := base, OpenAIChatRequest{}
+		vary(&request, &body)
+		if responseCacheKey(request, body) == baseKey {
+			t.Errorf("%s did not change the cache key", name)
+		}
+	}
+}
+
+func TestResponseCacheOnlyStoresFinishedAnswers(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		calls.Add(1)
+		finishReason := "stop"
+		if req.MaxTokens == 5 {
+			finishReason = "length"
+		}
+		writeSSE(w, RaycastSSEData{Reasoning: "Thinking"}, RaycastSSEData{Text: "Answer"}, RaycastSSEData{FinishReason: finishReason})
+	})
+	config := newTestConfig(upstream.URL)
+	config.ResponseCache = NewResponseCache(10)
+	router := Router(&config)
+
+	request := `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"Hi"}],"include_reasoning":true}`
+	for i := 0; i < 2; i++ {
+		recorder := doRequest(router, http.MethodPost, "/v1/chat/completions", request)
+		completion := decodeCompletion(t, recorder.Body)
+		choice := completion.Choices[0]
+		if choice.Message.Content != "Answer" || choice.Message.ReasoningContent != "Thinking" || choice.FinishReason != "stop" {
+			t.Fatalf("request %d: unexpected completion %s", i+1, recorder.Body)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected the second request to be served from the cache, upstream was called %d times", calls.Load())
+	}
+
+	// Another provider for the same model is a different request
+	doRequest(router, http.MethodPost, "/v1/chat/completions", request, "X-Provider", "azure_openai")
+	if calls.Load() != 2 {
+		t.Fatalf("X-Provider request was served from the cache")
+	}
+
+	// Truncated answers are not cached
+	truncated := `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"Hi"}],"max_tokens":5}`
+	for i := 0; i < 2; i++ {
+		recorder := doRequest(router, http.MethodPost, "/v1/chat/completions", truncated)
+		if reason := decodeCompletion(t, recorder.Body).Choices[0].FinishReason; reason != "length" {
+			t.Fatalf("expected finish reason length, got %s", reason)
+		}
+	}
+	if calls.Load() != 4 {
+		t.Fatalf("truncated answer was served from the cache")
+	}
+}
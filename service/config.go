@@ -13,31 +13,205 @@
 package service
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
 // Configuration constants
 const (
-	RaycastAPIURL    = "https://backend.raycast.com/api/v1/ai/chat_completions"
-	RaycastModelsURL = "https://backend.raycast.com/api/v1/ai/models"
-	UserAgent        = "Raycast/1.99.2 (macOS Version 15.5 (Build 24F74))"
-	DefaultProvider  = "anthropic"
-	DefaultModel     = "claude-3-7-sonnet-latest"
-	ModelCacheTTL    = 6 * time.Hour // Cache models for 6 hours
+	RaycastAPIURL            = "https://backend.raycast.com/api/v1/ai/chat_completions"
+	RaycastModelsURL         = "https://backend.raycast.com/api/v1/ai/models"
+	UserAgent                = "Raycast/1.99.2 (macOS Version 15.5 (Build 24F74))"
+	DefaultProvider          = "anthropic"
+	DefaultModel             = "claude-3-7-sonnet-latest"
+	DefaultSource            = "ai_chat"     // Source sent by the Raycast app
+	DefaultSystemInstruction = "markdown"    // Sent when the client provides no system message
+	ModelCacheTTL            = 6 * time.Hour // Cache models for 6 hours
+	ModelCreatedEpoch        = 1672531200    // 2023-01-01, base for the synthetic model creation timestamps
+	MaxSSELineBytes          = 1 << 20       // Longest single SSE line accepted from Raycast
+	StreamBufferSize         = 64            // Max parsed SSE events buffered between upstream and client
+
+	DefaultKeepaliveInterval = 15 * time.Second // Idle time before an SSE keepalive comment is sent
+	CoalesceMaxBytes         = 1024             // Coalesced text is sent early once it reaches this size
+
+	RaycastOrganizationHeader = "X-Raycast-Organization" // Carries the organization to Raycast
+	RaycastProjectHeader      = "X-Raycast-Project"      // Carries the project to Raycast
+
+	ContinuationPrompt = "Continue exactly where you left off, without repeating anything."
+
+	UpstreamErrorBodyBytes = 512 // Longest upstream error body included in error details
+
+	DefaultMaxRequestBytes = 10 << 20 // 10MB cap on chat request bodies
+
+	DefaultMaxIdleConnsPerHost = 10               // Idle upstream connections kept per host
+	DefaultUpstreamKeepAlive   = 30 * time.Second // TCP keepalive period for upstream connections
+	ChatRequestTimeout         = 5 * time.Minute  // Default deadline for chat completions, see REQUEST_TIMEOUT
+	DefaultMaxRequestTimeout   = 30 * time.Minute // Longest deadline a client can ask for with X-Request-Timeout
+	DefaultStreamWriteTimeout  = 30 * time.Second // Longest a single streaming write may block on a slow client
+	ModelsRequestTimeout       = 10 * time.Second // Short timeout for the models list
+
+	DefaultMaxRetries    = 2                // Retries for rate-limited upstream requests
+	DefaultRetryAfterMax = 30 * time.Second // Longest Retry-After delay honored before giving up
+
+	DefaultBreakerWindow   = 60 * time.Second // Window in which CIRCUIT_BREAKER_THRESHOLD failures must occur
+	DefaultBreakerCooldown = 30 * time.Second // How long the breaker stays open before probing
+)
+
+// Request context keys holding phase durations for the Server-Timing header
+const (
+	timingAuth     = "timing_auth"
+	timingConvert  = "timing_convert"
+	timingUpstream = "timing_upstream"
+)
+
+// providerKey is the request context key holding the resolved Raycast provider in debug mode
+const providerKey = "raycast_provider"
+
+// apiKeyKey is the request context key holding the client's API key once its credential headers are removed
+const apiKeyKey = "client_api_key"
+
+// ClientHeaders lists the incoming headers the proxy reads, besides standard HTTP headers such as
+// Content-Type and Accept-Encoding. Only OpenAI-Organization and OpenAI-Project are passed on to Raycast.
+var ClientHeaders = []string{"Content-Type", "Authorization", "X-Api-Key", "Api-Key", "Anthropic-Version", "OpenAI-Organization", "OpenAI-Project", "X-Request-Timeout", "X-Provider"}
+
+// CredentialHeaders are removed from each request after authentication, so client credentials
+// never reach handlers, logs or Raycast. Upstream requests only carry the server's bearer token.
+var CredentialHeaders = []string{"Authorization", "X-Api-Key", "Api-Key", "Proxy-Authorization", "Cookie"}
+
+// Build information, set with -ldflags, e.g. "-X github.com/missuo/raycast2api/service.Version=v1.0.0"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
 )
 
+// BuildInfo returns the build version, commit and date
+func BuildInfo() VersionInfo {
+	return VersionInfo{Version: Version, Commit: Commit, Date: BuildDate}
+}
+
+// startTime is when the process started, used to report uptime
+var startTime = time.Now()
+
+// ModelTypes lists the model types /v1/models can be filtered by
+var ModelTypes = []string{"chat", "embedding", "image"}
+
+// ProviderOwners maps Raycast providers to the organization reported as a model's owned_by.
+// Providers not listed are reported as-is.
+var ProviderOwners = map[string]string{
+	"openai_o1": "openai",
+}
+
+// DefaultModelProviders maps model ID prefixes to the provider assumed for DEFAULT_MODEL
+// while the model list can't be fetched. Other models are assumed to be served by DefaultProvider.
+var DefaultModelProviders = map[string]string{
+	"claude": "anthropic",
+	"gpt":    "openai",
+	"gemini": "google",
+}
+
+// LogitBiasProviders lists the Raycast providers that accept logit_bias
+var LogitBiasProviders = map[string]bool{
+	"openai": true,
+}
+
+// LogprobsProviders lists the Raycast providers that accept logprobs and top_logprobs
+var LogprobsProviders = map[string]bool{
+	"openai": true,
+}
+
+// ReasoningEffortProviders lists the Raycast providers that accept reasoning_effort
+var ReasoningEffortProviders = map[string]bool{
+	"openai": true,
+}
+
+// ThinkingProviders lists the Raycast providers that accept a thinking budget
+var ThinkingProviders = map[string]bool{
+	"anthropic": true,
+	"google":    true,
+}
+
 // Config represents the application configuration
 type Config struct {
-	RaycastBearerToken string
-	APIKey             string
-	ModelCache         *ModelCache
-	Port               string
+	RaycastBearerToken       string
+	TokenFile                *TokenFile      // Bearer token file, reloaded on SIGHUP
+	TokenRefresher           *TokenRefresher // nil when token refreshing is disabled
+	APIKey                   string
+	APIKeyFile               *APIKeyFile // API key file, reloaded on SIGHUP
+	AdminAPIKey              string      // Required by the /admin endpoints, which ENABLE_ADMIN turns on
+	Organization             string      // Forwarded to Raycast, per request from OpenAI-Organization
+	Project                  string      // Forwarded to Raycast, per request from OpenAI-Project
+	ModelCache               *ModelCache
+	Port                     string
+	Host                     string // Bind address, empty listens on all interfaces
+	RoutePrefix              string // Prepended to every route, empty for none
+	TrustProxy               bool   // Honor X-Forwarded-For when determining the client IP
+	TLSCertFile              string // Serve HTTPS with this certificate when set
+	TLSKeyFile               string
+	TLSClientCAFile          string   // Require client certificates signed by these CAs when set
+	UsageURL                 string   // Raycast usage endpoint, /v1/usage returns 501 when empty
+	APIURLs                  []string // Raycast chat completion URLs, tried in order on connection failure
+	ModelsURLs               []string // Raycast models URLs, tried in order on connection failure
+	Source                   string
+	KeepaliveInterval        time.Duration
+	CoalesceInterval         time.Duration // How long streamed text is buffered, 0 disables coalescing
+	DefaultModel             string
+	DefaultSystemInstruction string // Used when the client sends no system message, empty sends none
+	SystemFingerprint        string // Reported as system_fingerprint, varied per model when a seed is given
+	ModelCacheTTL            time.Duration
+	DryRun                   bool
+	Fixtures                 *Fixtures // nil unless recording or replaying upstream responses
+	Tracer                   *Tracer   // nil unless OTEL_EXPORTER_OTLP_ENDPOINT is set
+	Tokenizer                Tokenizer // Set per request for the backing model, counts usage and context tokens
+	StrictModel              bool
+	StrictParams             bool // Reject out-of-range sampling parameters instead of clamping
+	MaxContinuations         int
+	EnableAdmin              bool
+	MaxRequestBytes          int64
+	CloseConn                bool
+	Debug                    bool
+	MaxRetries               int
+	DefaultMaxTokens         int // Applied when the client sets no max_tokens, 0 sends none
+	RetryAfterMax            time.Duration
+	RequestTimeout           time.Duration // Deadline for each upstream chat request, 0 for none
+	MaxRequestTimeout        time.Duration // Cap on X-Request-Timeout
+	StreamWriteTimeout       time.Duration // Deadline for each streaming write, 0 disables
+	EnableCompression        bool
+	AutoTrim                 bool
+	FlattenMessages          bool                     // Collapse conversations into a single user message
+	QueueFeedback            bool                     // Send queue position comments to waiting streams
+	AllowedModels            map[string]bool          // Models clients may request, nil allows all
+	RealtimeOrigins          map[string]bool          // Cross-origin pages allowed to open /v1/realtime, "*" for any
+	ModelDefaults            map[string]ModelDefaults // Keyed by backing model, nil when none are configured
+	ModelsDisplayMap         map[string]string        // Model ID to the ID shown in /v1/models, nil when none are configured
+	ModelFallbacks           map[string][]string      // Keyed by backing model, nil when none are configured
+	HTTPClient               *http.Client             // Shared by all Raycast chat requests
+	ModelsClient             *http.Client             // Shares HTTPClient's transport with a shorter timeout
+	ModelRouter              *ModelRouter             // nil when no model routes are configured
+	ResponseCache            *ResponseCache           // nil when response caching is disabled
+	AuditLogger              *AuditLogger             // nil when audit logging is disabled
+	CircuitBreaker           *CircuitBreaker          // nil when the circuit breaker is disabled
+	UpstreamLimiter          *UpstreamLimiter         // nil when upstream concurrency is unlimited
+	StreamDeduper            *StreamDeduper           // nil when stream deduplication is disabled
+	IPFilter                 *IPFilter                // nil when no IP allowlist or denylist is set
+	IPRateLimiter            *IPRateLimiter           // nil when per-IP rate limiting is disabled
+	Moderator                *Moderator               // nil when MODERATION_URL is not set
+	Draining                 *atomic.Bool             // Set by /admin/drain to fail the readiness probe
 }
 
 // ErrorResponse represents an error response
@@ -53,78 +227,703 @@ type ErrorResponse struct {
 type ModelCache struct {
 	models    map[string]ModelCacheEntry
 	expiresAt time.Time
+	fetchedAt time.Time // Last successful fetch
 	mutex     sync.RWMutex
 }
 
+// ModelRouter represents weighted routing from model aliases to backing models
+type ModelRouter struct {
+	routes map[string][]ModelRoute
+	rng    *rand.Rand
+	mutex  sync.Mutex
+}
+
+// ModelRoute stores a backing model and its routing weight
+type ModelRoute struct {
+	Model  string
+	Weight int
+}
+
+// ModelDefaults holds per-model parameters applied when the client omits them
+type ModelDefaults struct {
+	Temperature *float64
+	MaxTokens   int
+}
+
 // ModelCacheEntry stores information about a model
 type ModelCacheEntry struct {
-	Model    string `json:"model"`
-	Provider string `json:"provider"`
+	Model         string   `json:"model"`
+	Provider      string   `json:"provider"`
+	ContextWindow int      `json:"context_window,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
+	Type          string   `json:"type,omitempty"`      // "chat", "embedding" or "image"
+	Providers     []string `json:"providers,omitempty"` // Every provider serving the model, Provider is the default
 }
 
 // validateAPIKey validates the API key from the request
 func validateAPIKey(c *gin.Context, config Config) bool {
-	if config.APIKey == "" {
+	keys := config.apiKeys()
+	if len(keys) == 0 {
 		return true // If no API key is set, allow all requests
 	}
 
+	token := requestAPIKey(c)
+	if token == "" {
+		return false
+	}
+
+	// Compare hashes in constant time so neither the key contents nor their lengths leak through timing.
+	// Every configured key is checked, even after a match.
+	tokenHash := sha256.Sum256([]byte(token))
+	valid := 0
+	for _, key := range keys {
+		keyHash := sha256.Sum256([]byte(key))
+		valid |= subtle.ConstantTimeCompare(keyHash[:], tokenHash[:])
+	}
+
+	return valid == 1
+}
+
+// validateAdminKey validates the admin API key from the request, rejecting every request when none is configured
+func validateAdminKey(c *gin.Context, config Config) bool {
+	if config.AdminAPIKey == "" {
+		return false
+	}
+
+	tokenHash := sha256.Sum256([]byte(requestAPIKey(c)))
+	keyHash := sha256.Sum256([]byte(config.AdminAPIKey))
+	return subtle.ConstantTimeCompare(keyHash[:], tokenHash[:]) == 1
+}
+
+// requestAPIKey extracts the client's API key from the request headers
+func requestAPIKey(c *gin.Context) string {
+	// Anthropic clients send the key in the x-api-key header
+	if token := c.GetHeader("X-Api-Key"); token != "" {
+		return token
+	}
+
+	// Azure OpenAI clients send it in the api-key header
+	if token := c.GetHeader("Api-Key"); token != "" {
+		return token
+	}
+
 	authHeader := c.GetHeader("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return false
+		return ""
 	}
 
 	// Extract the token from the Authorization header
-	token := strings.TrimPrefix(authHeader, "Bearer ")
+	return strings.TrimPrefix(authHeader, "Bearer ")
+}
+
+// parseURLList splits a comma-separated list of upstream URLs
+func parseURLList(list string) []string {
+	var urls []string
+	for _, url := range strings.Split(list, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// normalizeRoutePrefix returns the prefix with a leading slash and no trailing slash, or "" for none
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// setDefaults fills the dependencies and settings that InitConfig provides, so a Config
+// built by hand to embed the proxy can be served without setting each of them
+func (config *Config) setDefaults() {
+	if config.ModelCache == nil {
+		config.ModelCache = NewModelCache()
+	}
+	if config.HTTPClient == nil || config.ModelsClient == nil {
+		config.HTTPClient, config.ModelsClient = newUpstreamClients(DefaultMaxIdleConnsPerHost, DefaultUpstreamKeepAlive, config.CloseConn)
+	}
+	if config.Draining == nil {
+		config.Draining = &atomic.Bool{}
+	}
+	if len(config.APIURLs) == 0 {
+		config.APIURLs = []string{RaycastAPIURL}
+	}
+	if len(config.ModelsURLs) == 0 {
+		config.ModelsURLs = []string{RaycastModelsURL}
+	}
+	if config.ModelCacheTTL == 0 {
+		config.ModelCacheTTL = ModelCacheTTL
+	}
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+	if config.Source == "" {
+		config.Source = DefaultSource
+	}
+	if config.DefaultModel == "" {
+		config.DefaultModel = DefaultModel
+	}
+}
+
+// validate reports settings the proxy cannot be served with
+func (config Config) validate() error {
+	if config.bearerToken() == "" {
+		return errors.New("a Raycast bearer token is required, set RaycastBearerToken or TokenFile")
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		return errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if config.EnableAdmin && config.AdminAPIKey == "" {
+		return errors.New("EnableAdmin requires AdminAPIKey")
+	}
+	return nil
+}
+
+// modelAllowed reports whether clients may use a model, by its own or its display ID.
+// All models are allowed when no allowlist is set.
+func (config Config) modelAllowed(model string) bool {
+	return config.AllowedModels == nil || config.AllowedModels[model] || config.AllowedModels[config.realModelID(model)]
+}
 
-	// Split the config.APIKey by comma and trim spaces
-	validKeys := strings.Split(config.APIKey, ",")
-	for _, key := range validKeys {
-		if strings.TrimSpace(key) == token {
-			return true
+// parseAllowedModels parses a comma-separated model allowlist, returning nil when it is empty
+func parseAllowedModels(spec string) map[string]bool {
+	var allowed map[string]bool
+	for _, model := range strings.Split(spec, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			if allowed == nil {
+				allowed = make(map[string]bool)
+			}
+			allowed[model] = true
 		}
 	}
+	return allowed
+}
+
+// parseAllowedOrigins parses a comma-separated list of browser origins, returning nil when it is empty
+func parseAllowedOrigins(spec string) map[string]bool {
+	var allowed map[string]bool
+	for _, origin := range strings.Split(spec, ",") {
+		if origin = normalizeOrigin(origin); origin != "" {
+			if allowed == nil {
+				allowed = make(map[string]bool)
+			}
+			allowed[origin] = true
+		}
+	}
+	return allowed
+}
+
+// normalizeOrigin puts an origin in the form browsers send, e.g. "https://example.com"
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// withClientScope returns a copy of config using the organization and project from the client's
+// OpenAI-Organization and OpenAI-Project headers, falling back to the configured defaults
+func withClientScope(c *gin.Context, config Config) Config {
+	if organization := c.GetHeader("OpenAI-Organization"); organization != "" {
+		config.Organization = organization
+	}
+	if project := c.GetHeader("OpenAI-Project"); project != "" {
+		config.Project = project
+	}
+	return config
+}
 
-	return false
+// withRequestTimeout returns a copy of config using the timeout in seconds from the client's
+// X-Request-Timeout header, capped at config.MaxRequestTimeout
+func withRequestTimeout(c *gin.Context, config Config) Config {
+	header := c.GetHeader("X-Request-Timeout")
+	if header == "" {
+		return config
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		log.Printf("Ignoring invalid X-Request-Timeout: %q", header)
+		return config
+	}
+
+	config.RequestTimeout = time.Duration(seconds * float64(time.Second))
+	if config.MaxRequestTimeout > 0 && config.RequestTimeout > config.MaxRequestTimeout {
+		config.RequestTimeout = config.MaxRequestTimeout
+	}
+	return config
 }
 
 // getRaycastHeaders returns headers for Raycast API requests
 func getRaycastHeaders(config Config) map[string]string {
-	return map[string]string{
+	headers := map[string]string{
 		"Host":            "backend.raycast.com",
 		"Accept":          "application/json",
 		"User-Agent":      UserAgent,
-		"Authorization":   "Bearer " + config.RaycastBearerToken,
+		"Authorization":   "Bearer " + config.bearerToken(),
 		"Accept-Language": "en-US,en;q=0.9",
 		"Content-Type":    "application/json",
-		"Connection":      "close",
 	}
+	if config.CloseConn {
+		headers["Connection"] = "close"
+	}
+	if config.Organization != "" {
+		headers[RaycastOrganizationHeader] = config.Organization
+	}
+	if config.Project != "" {
+		headers[RaycastProjectHeader] = config.Project
+	}
+	return headers
+}
+
+// newUpstreamClients creates the HTTP clients shared by all Raycast requests.
+// Both use the same transport so connections and proxy settings are shared. Chat completions
+// have no client timeout, their deadline is set per request from config.RequestTimeout.
+func newUpstreamClients(maxIdleConnsPerHost int, keepAlive time.Duration, closeConn bool) (*http.Client, *http.Client) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.DisableKeepAlives = closeConn
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}).DialContext
+
+	chatClient := &http.Client{
+		Transport: transport,
+	}
+	modelsClient := &http.Client{
+		Transport: transport,
+		Timeout:   ModelsRequestTimeout,
+	}
+	return chatClient, modelsClient
+}
+
+// FileConfig represents the settings that can be loaded from a config file.
+// YAML is a superset of JSON, so both formats are decoded with the YAML parser.
+type FileConfig struct {
+	RaycastBearerToken       string `yaml:"raycast_bearer_token"`
+	RaycastBearerTokenFile   string `yaml:"raycast_bearer_token_file"`
+	TokenRefreshURL          string `yaml:"token_refresh_url"`
+	TokenRefreshMethod       string `yaml:"token_refresh_method"`
+	APIKey                   string `yaml:"api_key"`
+	APIKeyFile               string `yaml:"api_key_file"`
+	AdminAPIKey              string `yaml:"admin_api_key"`
+	Organization             string `yaml:"raycast_org"`
+	Project                  string `yaml:"raycast_project"`
+	Port                     string `yaml:"port"`
+	Host                     string `yaml:"host"`
+	RoutePrefix              string `yaml:"route_prefix"`
+	TrustProxy               bool   `yaml:"trust_proxy"`
+	TLSCertFile              string `yaml:"tls_cert_file"`
+	TLSKeyFile               string `yaml:"tls_key_file"`
+	TLSClientCAFile          string `yaml:"tls_client_ca_file"`
+	UsageURL                 string `yaml:"raycast_usage_url"`
+	APIURL                   string `yaml:"raycast_api_url"`
+	ModelsURL                string `yaml:"raycast_models_url"`
+	ModerationURL            string `yaml:"moderation_url"`
+	ModerationFail           string `yaml:"moderation_fail"`
+	RaycastSource            string `yaml:"raycast_source"`
+	SSEKeepaliveInterval     string `yaml:"sse_keepalive_interval"`
+	SSECoalesceMs            int    `yaml:"sse_coalesce_ms"`
+	DefaultModel             string `yaml:"default_model"`
+	DefaultSystemInstruction string `yaml:"default_system_instruction"`
+	SystemFingerprint        string `yaml:"system_fingerprint"`
+	AllowedModels            string `yaml:"allowed_models"`
+	RealtimeAllowedOrigins   string `yaml:"realtime_allowed_origins"`
+	ModelCacheTTL            string `yaml:"model_cache_ttl"`
+	DryRun                   bool   `yaml:"dry_run"`
+	RecordFixturesDir        string `yaml:"record_fixtures_dir"`
+	ReplayFixturesDir        string `yaml:"replay_fixtures_dir"`
+	OTLPEndpoint             string `yaml:"otel_exporter_otlp_endpoint"`
+	OTelServiceName          string `yaml:"otel_service_name"`
+	ResponseCacheSize        int    `yaml:"response_cache_size"`
+	StrictModel              bool   `yaml:"strict_model"`
+	StrictParams             bool   `yaml:"strict_params"`
+	MaxContinuations         int    `yaml:"max_continuations"`
+	EnableAdmin              bool   `yaml:"enable_admin"`
+	ModelRoutes              string `yaml:"model_routes"`
+	ModelDefaults            string `yaml:"model_defaults"`
+	ModelsDisplayMap         string `yaml:"models_display_map"`
+	ModelFallbacks           string `yaml:"model_fallbacks"`
+	MaxRequestBytes          int    `yaml:"max_request_bytes"`
+	MaxIdleConnsPerHost      int    `yaml:"raycast_max_idle_conns_per_host"`
+	UpstreamKeepAlive        string `yaml:"raycast_keepalive"`
+	CloseConn                bool   `yaml:"raycast_close_conn"`
+	AuditLogPath             string `yaml:"audit_log_path"`
+	Debug                    bool   `yaml:"debug"`
+	MaxRetries               int    `yaml:"upstream_max_retries"`
+	DefaultMaxTokens         int    `yaml:"default_max_tokens"`
+	RetryAfterMax            string `yaml:"retry_after_max"`
+	RequestTimeout           string `yaml:"request_timeout"`
+	MaxRequestTimeout        string `yaml:"max_request_timeout"`
+	StreamWriteTimeout       string `yaml:"stream_write_timeout"`
+	BreakerThreshold         int    `yaml:"circuit_breaker_threshold"`
+	BreakerWindow            string `yaml:"circuit_breaker_window"`
+	BreakerCooldown          string `yaml:"circuit_breaker_cooldown"`
+	EnableCompression        bool   `yaml:"enable_compression"`
+	AutoTrim                 bool   `yaml:"auto_trim"`
+	FlattenMessages          bool   `yaml:"flatten_messages"`
+	MaxConcurrentUpstream    int    `yaml:"max_concurrent_upstream"`
+	ConcurrencyOverflow      string `yaml:"concurrency_overflow"`
+	QueueFeedback            bool   `yaml:"queue_feedback"`
+	StreamDedup              bool   `yaml:"stream_dedup"`
+	IPAllowlist              string `yaml:"ip_allowlist"`
+	IPDenylist               string `yaml:"ip_denylist"`
+	IPRateLimitRPM           int    `yaml:"ip_rate_limit_rpm"`
+}
+
+// newFileConfig returns a FileConfig holding the defaults for settings that are not zero values
+func newFileConfig() *FileConfig {
+	return &FileConfig{
+		DefaultSystemInstruction: DefaultSystemInstruction,
+		TokenRefreshMethod:       http.MethodPost,
+		ModerationFail:           "closed",
+		OTelServiceName:          "raycast2api",
+		APIURL:                   RaycastAPIURL,
+		ModelsURL:                RaycastModelsURL,
+		SystemFingerprint:        versionFingerprint(),
+		MaxRequestBytes:          DefaultMaxRequestBytes,
+		MaxIdleConnsPerHost:      DefaultMaxIdleConnsPerHost,
+		MaxRetries:               DefaultMaxRetries,
+	}
+}
+
+// loadConfigFile loads settings from a YAML or JSON config file
+func loadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	fileConfig := newFileConfig()
+	if err := yaml.Unmarshal(data, fileConfig); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	return fileConfig, nil
+}
+
+// getSetting returns the environment variable if set, otherwise the config file value
+func getSetting(key string, fileValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileValue
+}
+
+// getOptionalSetting is like getSetting, but an environment variable set to an empty string overrides the config file
+func getOptionalSetting(key string, fileValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fileValue
+}
+
+// getIntSetting reads an integer from an environment variable or the config file
+func getIntSetting(key string, fileValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fileValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %v", key, value, fileValue)
+		return fileValue
+	}
+	return parsed
+}
+
+// getBoolSetting reads a boolean from an environment variable or the config file
+func getBoolSetting(key string, fileValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fileValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %v", key, value, fileValue)
+		return fileValue
+	}
+	return parsed
+}
+
+// getDurationSetting reads a duration from an environment variable or the config file.
+// Both Go duration strings ("15s") and plain seconds ("15") are accepted.
+func getDurationSetting(key string, fileValue string, defaultValue time.Duration) time.Duration {
+	value := getSetting(key, fileValue)
+	if value == "" {
+		return defaultValue
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	log.Printf("Invalid value for %s: %q, using default %v", key, value, defaultValue)
+	return defaultValue
 }
 
-// InitConfig initializes the configuration
-func InitConfig() *Config {
+// InitConfig initializes the configuration.
+// Settings are resolved in order: environment variables, then the config file, then defaults.
+// The config file path comes from the --config flag or the CONFIG_FILE environment variable.
+func InitConfig(configFile string) *Config {
 	// Initialize model cache
 	modelCache := NewModelCache()
 
-	// Load configuration from environment variables
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	fileConfig := newFileConfig()
+	if configFile != "" {
+		loaded, err := loadConfigFile(configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config file %s: %v", configFile, err)
+		}
+		fileConfig = loaded
+		log.Printf("Loaded config file: %s", configFile)
+	}
+
+	// Load configuration from environment variables, falling back to the config file
 	config := &Config{
-		RaycastBearerToken: os.Getenv("RAYCAST_BEARER_TOKEN"),
-		APIKey:             os.Getenv("API_KEY"),
-		ModelCache:         modelCache,
-		Port:               os.Getenv("PORT"),
+		RaycastBearerToken:       getSetting("RAYCAST_BEARER_TOKEN", fileConfig.RaycastBearerToken),
+		APIKey:                   getSetting("API_KEY", fileConfig.APIKey),
+		AdminAPIKey:              getSetting("ADMIN_API_KEY", fileConfig.AdminAPIKey),
+		Organization:             getSetting("RAYCAST_ORG", fileConfig.Organization),
+		Project:                  getSetting("RAYCAST_PROJECT", fileConfig.Project),
+		ModelCache:               modelCache,
+		Port:                     getSetting("PORT", fileConfig.Port),
+		Host:                     getSetting("HOST", getSetting("BIND_ADDRESS", fileConfig.Host)),
+		TrustProxy:               getBoolSetting("TRUST_PROXY", fileConfig.TrustProxy),
+		TLSCertFile:              getSetting("TLS_CERT_FILE", fileConfig.TLSCertFile),
+		TLSKeyFile:               getSetting("TLS_KEY_FILE", fileConfig.TLSKeyFile),
+		TLSClientCAFile:          getSetting("TLS_CLIENT_CA_FILE", fileConfig.TLSClientCAFile),
+		UsageURL:                 getSetting("RAYCAST_USAGE_URL", fileConfig.UsageURL),
+		APIURLs:                  parseURLList(getSetting("RAYCAST_API_URL", fileConfig.APIURL)),
+		ModelsURLs:               parseURLList(getSetting("RAYCAST_MODELS_URL", fileConfig.ModelsURL)),
+		RoutePrefix:              normalizeRoutePrefix(getSetting("ROUTE_PREFIX", fileConfig.RoutePrefix)),
+		Source:                   getSetting("RAYCAST_SOURCE", fileConfig.RaycastSource),
+		KeepaliveInterval:        getDurationSetting("SSE_KEEPALIVE_INTERVAL", fileConfig.SSEKeepaliveInterval, DefaultKeepaliveInterval),
+		CoalesceInterval:         time.Duration(getIntSetting("SSE_COALESCE_MS", fileConfig.SSECoalesceMs)) * time.Millisecond,
+		DefaultModel:             getSetting("DEFAULT_MODEL", fileConfig.DefaultModel),
+		DefaultSystemInstruction: getOptionalSetting("DEFAULT_SYSTEM_INSTRUCTION", fileConfig.DefaultSystemInstruction),
+		SystemFingerprint:        getSetting("SYSTEM_FINGERPRINT", fileConfig.SystemFingerprint),
+		ModelCacheTTL:            getDurationSetting("MODEL_CACHE_TTL", fileConfig.ModelCacheTTL, ModelCacheTTL),
+		DryRun:                   getBoolSetting("DRY_RUN", fileConfig.DryRun),
+		StrictModel:              getBoolSetting("STRICT_MODEL", fileConfig.StrictModel),
+		StrictParams:             getBoolSetting("STRICT_PARAMS", fileConfig.StrictParams),
+		MaxContinuations:         getIntSetting("MAX_CONTINUATIONS", fileConfig.MaxContinuations),
+		EnableAdmin:              getBoolSetting("ENABLE_ADMIN", fileConfig.EnableAdmin),
+		MaxRequestBytes:          int64(getIntSetting("MAX_REQUEST_BYTES", fileConfig.MaxRequestBytes)),
+		CloseConn:                getBoolSetting("RAYCAST_CLOSE_CONN", fileConfig.CloseConn),
+		Debug:                    getBoolSetting("DEBUG", fileConfig.Debug),
+		MaxRetries:               getIntSetting("UPSTREAM_MAX_RETRIES", fileConfig.MaxRetries),
+		DefaultMaxTokens:         getIntSetting("DEFAULT_MAX_TOKENS", fileConfig.DefaultMaxTokens),
+		EnableCompression:        getBoolSetting("ENABLE_COMPRESSION", fileConfig.EnableCompression),
+		AutoTrim:                 getBoolSetting("AUTO_TRIM", fileConfig.AutoTrim),
+		FlattenMessages:          getBoolSetting("FLATTEN_MESSAGES", fileConfig.FlattenMessages),
+		QueueFeedback:            getBoolSetting("QUEUE_FEEDBACK", fileConfig.QueueFeedback),
+		RetryAfterMax:            getDurationSetting("RETRY_AFTER_MAX", fileConfig.RetryAfterMax, DefaultRetryAfterMax),
+		RequestTimeout:           getDurationSetting("REQUEST_TIMEOUT", fileConfig.RequestTimeout, ChatRequestTimeout),
+		MaxRequestTimeout:        getDurationSetting("MAX_REQUEST_TIMEOUT", fileConfig.MaxRequestTimeout, DefaultMaxRequestTimeout),
+		StreamWriteTimeout:       getDurationSetting("STREAM_WRITE_TIMEOUT", fileConfig.StreamWriteTimeout, DefaultStreamWriteTimeout),
+		AllowedModels:            parseAllowedModels(getSetting("ALLOWED_MODELS", fileConfig.AllowedModels)),
+		RealtimeOrigins:          parseAllowedOrigins(getSetting("REALTIME_ALLOWED_ORIGINS", fileConfig.RealtimeAllowedOrigins)),
+	}
+
+	config.HTTPClient, config.ModelsClient = newUpstreamClients(
+		getIntSetting("RAYCAST_MAX_IDLE_CONNS_PER_HOST", fileConfig.MaxIdleConnsPerHost),
+		getDurationSetting("RAYCAST_KEEPALIVE", fileConfig.UpstreamKeepAlive, DefaultUpstreamKeepAlive),
+		config.CloseConn,
+	)
+
+	if path := getSetting("RAYCAST_BEARER_TOKEN_FILE", fileConfig.RaycastBearerTokenFile); path != "" {
+		tokenFile, err := NewTokenFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load RAYCAST_BEARER_TOKEN_FILE %s: %v", path, err)
+		}
+		// A rotated file replaces any token fetched by the refresher
+		tokenFile.watchReload(func() { config.TokenRefresher.Reset() })
+		config.TokenFile = tokenFile
+		log.Printf("Using bearer token from %s, send SIGHUP to reload", path)
+	}
+
+	if url := getSetting("TOKEN_REFRESH_URL", fileConfig.TokenRefreshURL); url != "" {
+		method := strings.ToUpper(getSetting("TOKEN_REFRESH_METHOD", fileConfig.TokenRefreshMethod))
+		if method != http.MethodGet && method != http.MethodPost {
+			log.Fatalf("Invalid TOKEN_REFRESH_METHOD %q, expected GET or POST", method)
+		}
+		config.TokenRefresher = NewTokenRefresher(url, method)
+		log.Printf("Bearer token will be refreshed from %s when Raycast rejects it", url)
+	}
+
+	if path := getSetting("API_KEY_FILE", fileConfig.APIKeyFile); path != "" {
+		keyFile, err := NewAPIKeyFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load API_KEY_FILE %s: %v", path, err)
+		}
+		keyFile.watchReload()
+		config.APIKeyFile = keyFile
+		log.Printf("Using %d API keys from %s, send SIGHUP to reload", len(keyFile.Keys()), path)
+	}
+
+	recordDir := getSetting("RECORD_FIXTURES_DIR", fileConfig.RecordFixturesDir)
+	replayDir := getSetting("REPLAY_FIXTURES_DIR", fileConfig.ReplayFixturesDir)
+	if recordDir != "" || replayDir != "" {
+		fixtures, err := NewFixtures(recordDir, replayDir)
+		if err != nil {
+			log.Fatalf("Failed to set up fixtures: %v", err)
+		}
+		config.Fixtures = fixtures
+		if recordDir != "" {
+			log.Printf("Recording upstream responses to %s", recordDir)
+		}
+		if replayDir != "" {
+			log.Printf("Replaying upstream responses from %s", replayDir)
+		}
+	}
+
+	if endpoint := getSetting("OTEL_EXPORTER_OTLP_ENDPOINT", fileConfig.OTLPEndpoint); endpoint != "" {
+		tracer, err := NewTracer(endpoint, getSetting("OTEL_SERVICE_NAME", fileConfig.OTelServiceName))
+		if err != nil {
+			log.Fatalf("Invalid OTEL_EXPORTER_OTLP_ENDPOINT: %v", err)
+		}
+		config.Tracer = tracer
+		log.Printf("Exporting traces to %s", endpoint)
 	}
 
 	// Log environment variable status
-	log.Printf("RAYCAST_BEARER_TOKEN: %s", map[bool]string{true: "Set", false: "Not set"}[config.RaycastBearerToken != ""])
-	log.Printf("API_KEY: %s", map[bool]string{true: "Set", false: "Not set"}[config.APIKey != ""])
+	log.Printf("RAYCAST_BEARER_TOKEN: %s", map[bool]string{true: "Set", false: "Not set"}[config.bearerToken() != ""])
+	log.Printf("API_KEY: %s", map[bool]string{true: "Set", false: "Not set"}[len(config.apiKeys()) > 0])
 
 	// Validate required environment variables
-	if config.RaycastBearerToken == "" {
-		log.Fatal("Missing required environment variable: RAYCAST_BEARER_TOKEN")
+	if config.bearerToken() == "" {
+		log.Fatal("Missing required environment variable: RAYCAST_BEARER_TOKEN or RAYCAST_BEARER_TOKEN_FILE")
 	}
 
-	if config.Port == "" {
-		config.Port = "8080"
+	if size := getIntSetting("RESPONSE_CACHE_SIZE", fileConfig.ResponseCacheSize); size > 0 {
+		config.ResponseCache = NewResponseCache(size)
+		log.Printf("Response cache enabled with %d entries", size)
+	}
+
+	if routes := getSetting("MODEL_ROUTES", fileConfig.ModelRoutes); routes != "" {
+		router, err := NewModelRouter(routes)
+		if err != nil {
+			log.Fatalf("Invalid MODEL_ROUTES: %v", err)
+		}
+		config.ModelRouter = router
+		log.Printf("Model routing enabled for %d aliases", len(router.routes))
+	}
+
+	if path := getSetting("AUDIT_LOG_PATH", fileConfig.AuditLogPath); path != "" {
+		auditLogger, err := NewAuditLogger(path)
+		if err != nil {
+			log.Fatalf("Failed to open audit log %s: %v", path, err)
+		}
+		config.AuditLogger = auditLogger
+		log.Printf("Audit logging enabled: %s", path)
+	}
+
+	if threshold := getIntSetting("CIRCUIT_BREAKER_THRESHOLD", fileConfig.BreakerThreshold); threshold > 0 {
+		config.CircuitBreaker = NewCircuitBreaker(
+			threshold,
+			getDurationSetting("CIRCUIT_BREAKER_WINDOW", fileConfig.BreakerWindow, DefaultBreakerWindow),
+			getDurationSetting("CIRCUIT_BREAKER_COOLDOWN", fileConfig.BreakerCooldown, DefaultBreakerCooldown),
+		)
+	}
+
+	if limit := getIntSetting("MAX_CONCURRENT_UPSTREAM", fileConfig.MaxConcurrentUpstream); limit > 0 {
+		overflow := getSetting("CONCURRENCY_OVERFLOW", fileConfig.ConcurrencyOverflow)
+		if overflow != "" && overflow != "queue" && overflow != "reject" {
+			log.Fatalf("Invalid CONCURRENCY_OVERFLOW %q, expected queue or reject", overflow)
+		}
+		config.UpstreamLimiter = NewUpstreamLimiter(limit, overflow == "reject")
+		log.Printf("Limiting Raycast to %d concurrent requests", limit)
+	}
+
+	if getBoolSetting("STREAM_DEDUP", fileConfig.StreamDedup) {
+		config.StreamDeduper = NewStreamDeduper()
+		log.Println("Identical concurrent streaming requests will share one upstream stream")
+	}
+
+	if spec := getSetting("MODEL_DEFAULTS", fileConfig.ModelDefaults); spec != "" {
+		defaults, err := parseModelDefaults(spec)
+		if err != nil {
+			log.Fatalf("Invalid MODEL_DEFAULTS: %v", err)
+		}
+		config.ModelDefaults = defaults
+		log.Printf("Default parameters configured for %d models", len(defaults))
+	}
+
+	if spec := getSetting("MODELS_DISPLAY_MAP", fileConfig.ModelsDisplayMap); spec != "" {
+		displayMap, err := parseModelsDisplayMap(spec)
+		if err != nil {
+			log.Fatalf("Invalid MODELS_DISPLAY_MAP: %v", err)
+		}
+		config.ModelsDisplayMap = displayMap
+		log.Printf("Display IDs configured for %d models", len(displayMap))
+	}
+
+	if spec := getSetting("MODEL_FALLBACKS", fileConfig.ModelFallbacks); spec != "" {
+		fallbacks, err := parseModelFallbacks(spec)
+		if err != nil {
+			log.Fatalf("Invalid MODEL_FALLBACKS: %v", err)
+		}
+		config.ModelFallbacks = fallbacks
+		log.Printf("Fallback models configured for %d models", len(fallbacks))
+	}
+
+	allowlist := getSetting("IP_ALLOWLIST", fileConfig.IPAllowlist)
+	denylist := getSetting("IP_DENYLIST", fileConfig.IPDenylist)
+	if allowlist != "" || denylist != "" {
+		ipFilter, err := NewIPFilter(allowlist, denylist)
+		if err != nil {
+			log.Fatalf("Invalid IP filter: %v", err)
+		}
+		config.IPFilter = ipFilter
+	}
+
+	if limit := getIntSetting("IP_RATE_LIMIT_RPM", fileConfig.IPRateLimitRPM); limit > 0 {
+		config.IPRateLimiter = NewIPRateLimiter(limit)
+		log.Printf("Limiting each IP address to %d requests per minute", limit)
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.TLSClientCAFile != "" {
+		if config.TLSCertFile == "" {
+			log.Fatal("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		log.Println("Requiring client certificates signed by TLS_CLIENT_CA_FILE")
+	}
+
+	if url := getSetting("MODERATION_URL", fileConfig.ModerationURL); url != "" {
+		failMode := getSetting("MODERATION_FAIL", fileConfig.ModerationFail)
+		if failMode != "open" && failMode != "closed" {
+			log.Fatalf("Invalid MODERATION_FAIL %q, must be open or closed", failMode)
+		}
+		config.Moderator = NewModerator(url, failMode == "open")
+		log.Printf("Moderating prompts with %s, failing %s", url, failMode)
+	}
+
+	// Admin endpoints can drain the instance, so a client API key is not enough to call them
+	if config.EnableAdmin && config.AdminAPIKey == "" {
+		log.Fatal("ENABLE_ADMIN requires ADMIN_API_KEY")
+	}
+
+	if config.DryRun {
+		log.Println("DRY_RUN is enabled, chat completions will echo the last user message without contacting Raycast")
 	}
 
+	config.setDefaults()
 	return config
 }
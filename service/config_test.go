@@ -0,0 +1,57 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name      string
+		fileLine  string // YAML setting the config file, when it has one
+		envKey    string
+		envValue  string
+		get       func(config *Config) interface{}
+		defaultIs interface{}
+		fileIs    interface{}
+		envIs     interface{}
+	}{
+		{"string", "default_model: gpt-4o", "DEFAULT_MODEL", "claude-sonnet",
+			func(config *Config) interface{} { return config.DefaultModel }, DefaultModel, "gpt-4o", "claude-sonnet"},
+		{"int", "upstream_max_retries: 5", "UPSTREAM_MAX_RETRIES", "7",
+			func(config *Config) interface{} { return config.MaxRetries }, DefaultMaxRetries, 5, 7},
+		{"bool", "debug: true", "DEBUG", "false",
+			func(config *Config) interface{} { return config.Debug }, false, true, false},
+		{"duration", "model_cache_ttl: 10m", "MODEL_CACHE_TTL", "20m",
+			func(config *Config) interface{} { return config.ModelCacheTTL }, ModelCacheTTL, 10 * time.Minute, 20 * time.Minute},
+		{"bytes", "max_request_bytes: 2048", "MAX_REQUEST_BYTES", "4096",
+			func(config *Config) interface{} { return config.MaxRequestBytes }, int64(DefaultMaxRequestBytes), int64(2048), int64(4096)},
+		// An empty environment variable only overrides the file for settings where empty means none
+		{"optional string", "default_system_instruction: be brief", "DEFAULT_SYSTEM_INSTRUCTION", "",
+			func(config *Config) interface{} { return config.DefaultSystemInstruction }, DefaultSystemInstruction, "be brief", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			emptyFile := filepath.Join(dir, "empty.yaml")
+			os.WriteFile(emptyFile, []byte("raycast_bearer_token: test-token\n"), 0o600)
+			settingFile := filepath.Join(dir, "config.yaml")
+			os.WriteFile(settingFile, []byte("raycast_bearer_token: test-token\n"+tt.fileLine+"\n"), 0o600)
+
+			t.Setenv(tt.envKey, "") // restores the variable after the test
+			os.Unsetenv(tt.envKey)
+			if got := tt.get(InitConfig(emptyFile)); got != tt.defaultIs {
+				t.Errorf("default: got %v, want %v", got, tt.defaultIs)
+			}
+			if got := tt.get(InitConfig(settingFile)); got != tt.fileIs {
+				t.Errorf("file: got %v, want %v", got, tt.fileIs)
+			}
+			t.Setenv(tt.envKey, tt.envValue)
+			if got := tt.get(InitConfig(settingFile)); got != tt.envIs {
+				t.Errorf("environment over file: got %v, want %v", got, tt.envIs)
+			}
+		})
+	}
+}
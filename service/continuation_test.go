@@ -0,0 +1,58 @@
+package service
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestContinueTruncatedResponse(t *testing.T) {
+	for _, lengthReason := range []string{"length", "max_tokens"} {
+		t.Run(lengthReason, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				calls.Add(1)
+				last := req.Messages[len(req.Messages)-1]
+				if last.Content.Text != ContinuationPrompt {
+					writeSSE(w, RaycastSSEData{Text: "Hello, "}, RaycastSSEData{FinishReason: lengthReason})
+					return
+				}
+				if previous := req.Messages[len(req.Messages)-2]; previous.Author != "assistant" || previous.Content.Text != "Hello, " {
+					t.Errorf("continuation did not carry the partial output, got %+v", previous)
+				}
+				writeSSE(w, RaycastSSEData{Text: "world"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.MaxContinuations = 2
+			router := Router(&config)
+
+			recorder := doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+			choice := decodeCompletion(t, recorder.Body).Choices[0]
+			if choice.Message.Content != "Hello, world" || choice.FinishReason != "stop" {
+				t.Fatalf("got %q with finish reason %s", choice.Message.Content, choice.FinishReason)
+			}
+			if calls.Load() != 2 {
+				t.Fatalf("expected one continuation, upstream was called %d times", calls.Load())
+			}
+		})
+	}
+}
+
+func TestContinueTruncatedResponseStopsAtClientLimit(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		calls.Add(1)
+		writeSSE(w, RaycastSSEData{Text: "This answer is already longer than the limit"}, RaycastSSEData{FinishReason: "max_tokens"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.MaxContinuations = 2
+	router := Router(&config)
+
+	recorder := doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","max_tokens":5,"messages":[{"role":"user","content":"Hi"}]}`)
+	if reason := decodeCompletion(t, recorder.Body).Choices[0].FinishReason; reason != "length" {
+		t.Fatalf("expected finish reason length, got %s", reason)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("continued past the client's max_tokens, upstream was called %d times", calls.Load())
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 15:48:26
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 15:48:26
+ * @FilePath: /raycast2api/service/dedup.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// StreamDeduper lets identical concurrent streaming requests share a single upstream stream
+type StreamDeduper struct {
+	streams map[string]*SharedStream
+	mutex   sync.Mutex
+}
+
+// SharedStream multicasts the events of one upstream stream to any number of subscribers.
+// Events are kept for the lifetime of the stream, so late subscribers replay them from the start.
+type SharedStream struct {
+	history  []RaycastSSEData
+	finished bool
+	mutex    sync.Mutex
+	cond     *sync.Cond
+}
+
+// NewStreamDeduper creates a new stream deduper
+func NewStreamDeduper() *StreamDeduper {
+	return &StreamDeduper{
+		streams: make(map[string]*SharedStream),
+	}
+}
+
+// Join returns the in-flight stream for key, creating one if there is none.
+// leader is true for the caller that created it, which must then call Start or Fail.
+func (sd *StreamDeduper) Join(key string) (*SharedStream, bool) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	if stream, ok := sd.streams[key]; ok {
+		return stream, false
+	}
+
+	stream := &SharedStream{}
+	stream.cond = sync.NewCond(&stream.mutex)
+	sd.streams[key] = stream
+	return stream, true
+}
+
+// Start reads the upstream body into the stream. The stream owns the body from now on,
+// so it keeps running for the other subscribers when the leader's client disconnects.
+func (sd *StreamDeduper) Start(key string, stream *SharedStream, body io.ReadCloser) {
+	events := make(chan RaycastSSEData, StreamBufferSize)
+	go pumpSSEEvents(body, events, make(chan struct{}))
+
+	go func() {
+		defer body.Close()
+		for event := range events {
+			stream.publish(event)
+		}
+		sd.finish(key, stream)
+	}()
+}
+
+// Fail ends a stream whose upstream request failed, so subscribers finish with an error
+func (sd *StreamDeduper) Fail(key string, stream *SharedStream) {
+	stream.publish(RaycastSSEData{FinishReason: "error"})
+	sd.finish(key, stream)
+}
+
+// finish marks the stream complete and removes it, so later requests start a new upstream call
+func (sd *StreamDeduper) finish(key string, stream *SharedStream) {
+	sd.mutex.Lock()
+	if sd.streams[key] == stream {
+		delete(sd.streams, key)
+	}
+	sd.mutex.Unlock()
+
+	stream.mutex.Lock()
+	stream.finished = true
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+}
+
+// publish appends an event and wakes up waiting subscribers
+func (ss *SharedStream) publish(event RaycastSSEData) {
+	ss.mutex.Lock()
+	ss.history = append(ss.history, event)
+	ss.mutex.Unlock()
+	ss.cond.Broadcast()
+}
+
+// Subscribe returns a channel receiving every event of the stream, closed when the stream ends.
+// Closing done unsubscribes without affecting other subscribers.
+func (ss *SharedStream) Subscribe(done <-chan struct{}) <-chan RaycastSSEData {
+	events := make(chan RaycastSSEData, StreamBufferSize)
+
+	go func() {
+		defer close(events)
+		for next := 0; ; next++ {
+			ss.mutex.Lock()
+			for next >= len(ss.history) && !ss.finished {
+				ss.cond.Wait()
+			}
+			if next >= len(ss.history) {
+				ss.mutex.Unlock()
+				return
+			}
+			event := ss.history[next]
+			ss.mutex.Unlock()
+
+			select {
+			case events <- event:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return events
+}
+
+// streamDedupKey identifies requests that would produce the same upstream stream
+func streamDedupKey(raycastRequest RaycastChatRequest) string {
+	raycastRequest.ThreadID = "" // A fresh thread ID is generated for every request
+	keyData, _ := json.Marshal(raycastRequest)
+
+	hash := sha256.Sum256(keyData)
+	return hex.EncodeToString(hash[:])
+}
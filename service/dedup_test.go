@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collect drains a subscription, failing the test if it doesn't end in time
+func collect(t *testing.T, events <-chan RaycastSSEData) []RaycastSSEData {
+	t.Helper()
+	var received []RaycastSSEData
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received
+			}
+			received = append(received, event)
+		case <-timeout:
+			t.Fatal("subscription did not end")
+		}
+	}
+}
+
+func TestStreamDeduperLateSubscriberReplays(t *testing.T) {
+	deduper := NewStreamDeduper()
+	stream, leader := deduper.Join("key")
+	if !leader {
+		t.Fatal("first request did not lead")
+	}
+
+	body := io.NopCloser(strings.NewReader("data: {\"text\":\"Hel\"}\n\ndata: {\"text\":\"lo\"}\n\ndata: {\"finish_reason\":\"stop\"}\n\n"))
+	deduper.Start("key", stream, body)
+	first := collect(t, stream.Subscribe(make(chan struct{})))
+
+	// The stream has ended, but a subscriber that already joined still replays it from the start
+	second := collect(t, stream.Subscribe(make(chan struct{})))
+	if len(first) != 3 || len(second) != 3 || second[0].Text != "Hel" || second[2].FinishReason != "stop" {
+		t.Fatalf("subscribers saw different events: %+v and %+v", first, second)
+	}
+
+	// A finished stream is removed, so the next request starts a new one
+	if _, leader := deduper.Join("key"); !leader {
+		t.Fatal("request after the stream ended joined the finished stream")
+	}
+}
+
+func TestStreamDeduperFail(t *testing.T) {
+	deduper := NewStreamDeduper()
+	stream, _ := deduper.Join("key")
+	follower, leader := deduper.Join("key")
+	if leader || follower != stream {
+		t.Fatal("identical request did not join the in-flight stream")
+	}
+
+	deduper.Fail("key", stream)
+	events := collect(t, follower.Subscribe(make(chan struct{})))
+	if len(events) != 1 || events[0].FinishReason != "error" {
+		t.Fatalf("expected a single error event, got %+v", events)
+	}
+}
+
+// streamedText reads a chat completion stream and returns its concatenated content
+func streamedText(t *testing.T, body io.Reader) string {
+	t.Helper()
+	var text strings.Builder
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk OpenAIChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Errorf("invalid chunk %q: %v", data, err) // Called from request goroutines, which must not use Fatal
+			break
+		}
+		if len(chunk.Choices) > 0 {
+			text.WriteString(chunk.Choices[0].Delta.Content)
+		}
+	}
+	return text.String()
+}
+
+func TestIdenticalStreamsShareUpstream(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		writeSSE(w, RaycastSSEData{Text: "Hel"})
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+		writeSSE(w, RaycastSSEData{Text: "lo"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.StreamDeduper = NewStreamDeduper()
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	texts := make([]string, 2)
+	var wg sync.WaitGroup
+	stream := func(i int) {
+		defer wg.Done()
+		resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+			strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true}`))
+		if err != nil {
+			t.Errorf("request %d failed: %v", i+1, err)
+			return
+		}
+		defer resp.Body.Close()
+		texts[i] = streamedText(t, resp.Body)
+	}
+
+	wg.Add(2)
+	go stream(0)
+	<-started
+	go stream(1)
+	time.Sleep(100 * time.Millisecond) // Let the second request join the in-flight stream
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected one upstream request, got %d", calls.Load())
+	}
+	for i, text := range texts {
+		if text != "Hello" {
+			t.Fatalf("request %d: expected Hello, got %q", i+1, text)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q): expected %v, got %v", tt.ifNoneMatch, tt.want, got)
+		}
+	}
+}
+
+func TestModelsConditionalGet(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {})
+	config := newTestConfig(upstream.URL)
+	router := Router(&config)
+
+	w := doRequest(router, http.MethodGet, "/v1/models", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d and %q", w.Code, etag)
+	}
+
+	// The same list is not sent again
+	w = doRequest(router, http.MethodGet, "/v1/models", "", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Fatalf("304 response carries ETag %q, expected %q", w.Header().Get("ETag"), etag)
+	}
+
+	// A stale ETag gets the full list
+	w = doRequest(router, http.MethodGet, "/v1/models", "", "If-None-Match", `"stale"`)
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("expected 200 with the list for a stale ETag, got %d", w.Code)
+	}
+
+	// A filtered list is a different representation with its own ETag
+	w = doRequest(router, http.MethodGet, "/v1/models?owned_by=openai", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("filtered list matched the full list's ETag, got %d", w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// newFallbackUpstream fails requests for the models in failures with their status and body, and records the models tried
+func newFallbackUpstream(t *testing.T, failures map[string]int, failureBody string) (*[]string, Config) {
+	t.Helper()
+	var mutex sync.Mutex
+	var tried []string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		mutex.Lock()
+		tried = append(tried, req.Provider+"/"+req.Model)
+		mutex.Unlock()
+		if status, ok := failures[req.Model]; ok {
+			w.WriteHeader(status)
+			w.Write([]byte(failureBody))
+			return
+		}
+		writeSSE(w, RaycastSSEData{Text: "Hi from " + req.Model}, RaycastSSEData{FinishReason: "stop"})
+	})
+	return &tried, newTestConfig(upstream.URL)
+}
+
+func TestModelFallbacks(t *testing.T) {
+	tests := []struct {
+		name        string
+		fallbacks   []string
+		failures    map[string]int
+		failureBody string
+		wantStatus  int
+		wantTried   []string
+	}{
+		{
+			name:       "server error falls back",
+			fallbacks:  []string{"claude-sonnet"},
+			failures:   map[string]int{"gpt-4o": http.StatusInternalServerError},
+			wantStatus: http.StatusOK,
+			wantTried:  []string{"openai/gpt-4o", "anthropic/claude-sonnet"},
+		},
+		{
+			name:        "unavailable model falls back",
+			fallbacks:   []string{"claude-sonnet"},
+			failures:    map[string]int{"gpt-4o": http.StatusBadRequest},
+			failureBody: `{"error":"model not found"}`,
+			wantStatus:  http.StatusOK,
+			wantTried:   []string{"openai/gpt-4o", "anthropic/claude-sonnet"},
+		},
+		{
+			name:        "client error does not fall back",
+			fallbacks:   []string{"claude-sonnet"},
+			failures:    map[string]int{"gpt-4o": http.StatusBadRequest},
+			failureBody: `{"error":"invalid temperature"}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTried:   []string{"openai/gpt-4o"},
+		},
+		{
+			name:       "unknown fallback is skipped",
+			fallbacks:  []string{"no-such-model", "claude-sonnet"},
+			failures:   map[string]int{"gpt-4o": http.StatusServiceUnavailable},
+			wantStatus: http.StatusOK,
+			wantTried:  []string{"openai/gpt-4o", "anthropic/claude-sonnet"},
+		},
+		{
+			name:       "last failure is returned",
+			fallbacks:  []string{"claude-sonnet"},
+			failures:   map[string]int{"gpt-4o": http.StatusInternalServerError, "claude-sonnet": http.StatusBadGateway},
+			wantStatus: http.StatusBadGateway,
+			wantTried:  []string{"openai/gpt-4o", "anthropic/claude-sonnet"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tried, config := newFallbackUpstream(t, tt.failures, tt.failureBody)
+			config.ModelFallbacks = map[string][]string{"gpt-4o": tt.fallbacks}
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if !slices.Equal(*tried, tt.wantTried) {
+				t.Fatalf("expected %v to be tried, got %v", tt.wantTried, *tried)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got := decodeCompletion(t, w.Body).Choices[0].Message.Content; got != "Hi from claude-sonnet" {
+					t.Fatalf("expected the fallback's answer, got %q", got)
+				}
+			}
+		})
+	}
+}
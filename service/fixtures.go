@@ -0,0 +1,133 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 19:42:18
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 19:42:18
+ * @FilePath: /raycast2api/service/fixtures.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ErrFixtureNotFound is returned in replay mode when no response was recorded for a request
+var ErrFixtureNotFound = errors.New("no recorded fixture for request")
+
+// Fixtures records upstream chat requests and their raw SSE responses to disk and replays them.
+// Fixtures are named by the hash of the request, so identical requests share one fixture.
+type Fixtures struct {
+	recordDir string // Empty when not recording
+	replayDir string // Empty when not replaying
+}
+
+// NewFixtures creates a fixture store recording to recordDir and replaying from replayDir.
+// With both set, recorded responses are replayed and missing ones are fetched and recorded.
+func NewFixtures(recordDir string, replayDir string) (*Fixtures, error) {
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0o755); err != nil {
+			return nil, fmt.Errorf("error creating fixtures directory: %w", err)
+		}
+	}
+	if replayDir != "" {
+		if info, err := os.Stat(replayDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("fixtures directory %s does not exist", replayDir)
+		}
+	}
+	return &Fixtures{recordDir: recordDir, replayDir: replayDir}, nil
+}
+
+// Replay returns the recorded response for a request. The bool is false when upstream should be called,
+// and ErrFixtureNotFound is returned when a replay-only store has no fixture. A nil store never replays.
+func (f *Fixtures) Replay(raycastRequest RaycastChatRequest) (*http.Response, bool, error) {
+	if f == nil || f.replayDir == "" {
+		return nil, false, nil
+	}
+
+	hash := fixtureHash(raycastRequest)
+	file, err := os.Open(filepath.Join(f.replayDir, hash+".sse"))
+	if err != nil {
+		if f.recordDir != "" {
+			return nil, false, nil // Record it instead
+		}
+		return nil, true, fmt.Errorf("%w %s", ErrFixtureNotFound, hash)
+	}
+
+	log.Printf("Replaying fixture %s", hash)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       file,
+	}, true, nil
+}
+
+// Record saves the request and, once the body has been read to the end and closed, the raw response.
+// Only successful responses are recorded. A nil store records nothing.
+func (f *Fixtures) Record(raycastRequest RaycastChatRequest, resp *http.Response) {
+	if f == nil || f.recordDir == "" || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	hash := fixtureHash(raycastRequest)
+	requestBody, _ := json.MarshalIndent(raycastRequest, "", "  ")
+	if err := os.WriteFile(filepath.Join(f.recordDir, hash+".json"), requestBody, 0o644); err != nil {
+		log.Printf("Failed to record fixture request: %v", err)
+		return
+	}
+	resp.Body = &fixtureRecorder{ReadCloser: resp.Body, path: filepath.Join(f.recordDir, hash+".sse")}
+}
+
+// fixtureHash identifies a request by its content. The thread ID is random per request, so it is left out.
+func fixtureHash(raycastRequest RaycastChatRequest) string {
+	raycastRequest.ThreadID = ""
+	requestBody, _ := json.Marshal(raycastRequest)
+	sum := sha256.Sum256(requestBody)
+	return hex.EncodeToString(sum[:])
+}
+
+// fixtureRecorder copies a response body as it is read and saves it when closed.
+// Responses that were not read to the end, e.g. because the client disconnected, are discarded.
+type fixtureRecorder struct {
+	io.ReadCloser
+	path     string
+	body     bytes.Buffer
+	complete bool
+}
+
+func (fr *fixtureRecorder) Read(p []byte) (int, error) {
+	n, err := fr.ReadCloser.Read(p)
+	fr.body.Write(p[:n])
+	if err == io.EOF {
+		fr.complete = true
+	}
+	return n, err
+}
+
+// Close closes the body and writes the fixture if the response was complete
+func (fr *fixtureRecorder) Close() error {
+	err := fr.ReadCloser.Close()
+	if fr.complete {
+		if writeErr := os.WriteFile(fr.path, fr.body.Bytes(), 0o644); writeErr != nil {
+			log.Printf("Failed to record fixture response: %v", writeErr)
+		} else {
+			log.Printf("Recorded fixture %s", filepath.Base(fr.path))
+		}
+		fr.complete = false
+	}
+	return err
+}
@@ -13,23 +13,53 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // handleChatCompletions handles OpenAI chat completions endpoint
 func handleChatCompletions(c *gin.Context, config Config) {
+	requestStart := time.Now()
+	config = withClientScope(c, config)
+	config = withRequestTimeout(c, config)
+
+	// Cap the request body size to protect against oversized requests
+	if config.MaxRequestBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxRequestBytes)
+	}
+
 	var body OpenAIChatRequest
 	if err := c.ShouldBindJSON(&body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesErr.Limit),
+					Type:    "invalid_request_error",
+				},
+			})
+			return
+		}
+
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
@@ -58,102 +88,286 @@ func handleChatCompletions(c *gin.Context, config Config) {
 		return
 	}
 
-	// Use default model if not specified
+	if err := validateLogitBias(body.LogitBias); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: "Invalid 'logit_bias' field",
+				Type:    "invalid_request_error",
+				Details: err.Error(),
+			},
+		})
+		return
+	}
+
+	if config.StrictParams {
+		if err := validateParams(body); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: err.Error(),
+					Type:    "invalid_request_error",
+				},
+			})
+			return
+		}
+	}
+
+	// Use default model if not specified. Azure clients name the deployment in the path instead.
 	model := body.Model
+	if deployment := c.Param("deployment"); deployment != "" {
+		model = deployment
+	}
 	if model == "" {
-		model = DefaultModel
+		model = config.DefaultModel
 	}
 
-	// Use default temperature if not specified
-	temperature := body.Temperature
-	if temperature == 0 {
-		temperature = 0.5
+	if !config.modelAllowed(model) {
+		c.JSON(http.StatusForbidden, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: fmt.Sprintf("The model '%s' is not allowed", model),
+				Type:    "model_not_allowed",
+			},
+		})
+		return
 	}
 
 	stream := body.Stream
 
-	// Get models from cache or fetch them if cache is expired
-	models, err := config.ModelCache.GetModels(config)
-	if err != nil {
-		log.Printf("Warning: Using models with possible error: %v", err)
+	// In dry-run mode, echo the last user message without contacting Raycast
+	if config.DryRun {
+		messageResult := convertMessages(body.Messages, config.DefaultSystemInstruction)
+		resp := newDryRunResponse(messageResult.RaycastMessages)
+		defer resp.Body.Close()
+		if stream {
+			handleStreamingResponse(c, resp, model, config, body.IncludeReasoning)
+		} else {
+			handleNonStreamingResponse(c, resp, model, config, nil, body, "", config.Tokenizer.CountPrompt(messageResult))
+		}
+		return
 	}
 
-	// Get provider info from the models
-	provider, modelName := getProviderInfo(model, models)
-	log.Printf("Using provider: %s, model: %s", provider, modelName)
+	prepared, prepareErr := prepareChatRequest(c, &config, model, &body)
+	if prepareErr != nil {
+		errorType := "invalid_request_error"
+		if prepareErr.Status == http.StatusNotFound {
+			errorType = "model_not_found"
+		}
+		c.JSON(prepareErr.Status, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: prepareErr.Message,
+				Type:    errorType,
+			},
+		})
+		return
+	}
+	models, provider, modelName, messageResult := prepared.Models, prepared.Provider, prepared.ModelName, prepared.Messages
+	temperature := prepared.Temperature
 
 	// Create a unique thread ID for this conversation
 	threadId := uuid.New().String()
 
-	// Convert messages and extract system instruction
-	messageResult := convertMessages(body.Messages)
-
 	// Prepare Raycast request
 	raycastRequest := RaycastChatRequest{
-		AdditionalSystemInstructions: "",
+		AdditionalSystemInstructions: body.AdditionalSystemInstructions,
 		Debug:                        false,
 		Locale:                       "en-US",
 		Messages:                     messageResult.RaycastMessages,
 		Model:                        modelName,
 		Provider:                     provider,
-		Source:                       "ai_chat",
+		Source:                       config.Source,
 		SystemInstruction:            messageResult.SystemInstruction,
 		Temperature:                  temperature,
+		MaxTokens:                    resolveMaxTokens(body),
+		LogitBias:                    providerLogitBias(provider, body.LogitBias),
+		Seed:                         body.Seed,
 		ThreadID:                     threadId,
-		Tools: []struct {
-			Name string `json:"name"`
-			Type string `json:"type"`
-		}{
-			// Uncomment to enable tools
-			// {Name: "web_search", Type: "remote_tool"},
-			// {Name: "search_images", Type: "remote_tool"},
-		},
+		Tools:                        raycastTools(body),
 	}
 
-	requestBody, err := json.Marshal(raycastRequest)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+	applyProviderTweaks(provider, body, &raycastRequest)
+
+	// Raycast has no structured output field, so the schema is passed as an instruction
+	if instruction := schemaInstruction(body.ResponseFormat); instruction != "" {
+		if raycastRequest.AdditionalSystemInstructions != "" {
+			instruction = raycastRequest.AdditionalSystemInstructions + "\n\n" + instruction
+		}
+		raycastRequest.AdditionalSystemInstructions = instruction
+	}
+
+	// Block flagged prompts before they reach Raycast, checking everything that will be sent
+	if flagged, err := config.Moderator.Check(moderationInput(raycastRequest)); err != nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
 			}{
-				Message: "Failed to marshal request",
+				Message: "Unable to moderate the request, please retry later",
 				Type:    "server_error",
-				Details: err.Error(),
 			},
 		})
 		return
+	} else if flagged {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: "The request was rejected by content moderation",
+				Type:    "content_filter",
+			},
+		})
+		return
+	}
+
+	// Surface the exact upstream request to help diagnose ignored parameters
+	if config.Debug {
+		c.Header("X-Raycast-Request", redactedRequestBody(config, raycastRequest))
+	}
+
+	// Serve deterministic non-streaming requests from the response cache, which doesn't keep logprobs
+	cacheKey := ""
+	if config.ResponseCache != nil && !stream && temperature == 0 && !body.Logprobs {
+		cacheKey = responseCacheKey(raycastRequest, body)
+		if cached, ok := config.ResponseCache.Get(cacheKey); ok {
+			log.Printf("Serving cached response for model: %s", model)
+			promptTokens := config.Tokenizer.CountPrompt(messageResult)
+			writeChatCompletion(c, cached.Text, cached.Reasoning, cached.Annotations, nil, cached.FinishReason, model, systemFingerprint(config.SystemFingerprint, model, body.Seed), promptTokens, config)
+			config.AuditLogger.Log(c, model, promptTokens, config.Tokenizer.Count(cached.Text), cached.FinishReason, true, body.Metadata)
+			return
+		}
 	}
 
-	log.Printf("Sending request to Raycast: %s", string(requestBody))
+	// Share one upstream stream between identical concurrent streaming requests
+	var shared *SharedStream
+	var dedupKey string
+	sharedStarted := false
+	if stream && config.StreamDeduper != nil {
+		var leader bool
+		dedupKey = streamDedupKey(raycastRequest)
+		shared, leader = config.StreamDeduper.Join(dedupKey)
+		if !leader {
+			log.Println("Joining an identical in-flight stream")
+			done := make(chan struct{})
+			fullText, finishReason := streamEvents(c, shared.Subscribe(done), done, model, config, body.IncludeReasoning)
+			config.AuditLogger.Log(c, model, config.Tokenizer.CountPrompt(messageResult), config.Tokenizer.Count(fullText), finishReason, false, body.Metadata)
+			return
+		}
 
-	client := &http.Client{
-		Timeout: 5 * time.Minute, // Longer timeout for chat completions
+		// If the upstream request fails, end the stream for any requests that joined it
+		defer func() {
+			if !sharedStarted {
+				config.StreamDeduper.Fail(dedupKey, shared)
+			}
+		}()
 	}
-	req, err := http.NewRequest("POST", RaycastAPIURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+
+	// Any upstream request ends with its client, except a shared stream, which outlives
+	// the request that started it but stays in its trace
+	upstreamContext := c.Request.Context()
+	if shared != nil {
+		upstreamContext = context.WithoutCancel(upstreamContext)
+	}
+
+	// Once a queued stream has started, headers can only follow as trailers and
+	// errors only as an error event carrying the body the status would have come with
+	queued := false
+	setHeader := func(key, value string) {
+		if queued {
+			key = http.TrailerPrefix + key
+		}
+		c.Header(key, value)
+	}
+	writeError := func(status int, errorResponse ErrorResponse) {
+		if !queued {
+			c.JSON(status, errorResponse)
+			return
+		}
+		errorData, _ := json.Marshal(errorResponse)
+		fmt.Fprintf(c.Writer, "data: %s\n\ndata: [DONE]\n\n", errorData)
+		c.Writer.Flush()
+	}
+
+	// Tell streaming clients waiting for a concurrency slot where they are in the queue
+	var notify func(position int)
+	if stream && config.QueueFeedback {
+		notify = func(position int) {
+			if !queued {
+				queued = true
+				c.Header("Content-Type", "text/event-stream")
+				c.Header("Cache-Control", "no-cache")
+				c.Header("Connection", "keep-alive")
+				c.Status(http.StatusOK)
+			}
+			fmt.Fprintf(c.Writer, ": queued position=%d\n\n", position)
+			c.Writer.Flush()
+		}
+	}
+
+	upstreamStart := time.Now()
+	resp, err := sendWithFallbacks(upstreamContext, config, &raycastRequest, body, models, notify)
+	if raycastRequest.Model != modelName {
+		modelName, provider = raycastRequest.Model, raycastRequest.Provider
+		config.Tokenizer = NewTokenizer(provider, modelName)
+		if config.Debug {
+			c.Set(providerKey, provider)
+		}
+	}
+
+	// Report where the time went; for streams the total covers the time until the first byte
+	if config.Debug {
+		setHeader("X-Served-Model", modelName)
+		setHeader("X-Upstream-Latency-Ms", fmt.Sprint(time.Since(upstreamStart).Milliseconds()))
+		setHeader("X-Total-Latency-Ms", fmt.Sprint(time.Since(requestStart).Milliseconds()))
+	}
+	c.Set(timingUpstream, time.Since(upstreamStart))
+
+	if errors.Is(err, ErrUpstreamBusy) {
+		writeError(http.StatusTooManyRequests, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
 			}{
-				Message: "Error creating request",
-				Type:    "server_error",
+				Message: "Too many concurrent requests, please retry later",
+				Type:    "rate_limit_exceeded",
 				Details: err.Error(),
 			},
 		})
 		return
 	}
-
-	for key, value := range getRaycastHeaders(config) {
-		req.Header.Set(key, value)
+	if errors.Is(err, ErrCircuitOpen) {
+		writeError(http.StatusServiceUnavailable, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: "Raycast is temporarily unavailable, please retry later",
+				Type:    "service_unavailable",
+				Details: err.Error(),
+			},
+		})
+		return
 	}
-
-	resp, err := client.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+		writeError(http.StatusInternalServerError, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
@@ -166,9 +380,12 @@ func handleChatCompletions(c *gin.Context, config Config) {
 		})
 		return
 	}
-	defer resp.Body.Close()
-
-	log.Printf("Response status: %d", resp.StatusCode)
+	defer func() {
+		// Once started, the shared stream owns the body
+		if !sharedStarted {
+			resp.Body.Close()
+		}
+	}()
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
@@ -181,66 +398,522 @@ func handleChatCompletions(c *gin.Context, config Config) {
 			errorText = string(jsonBytes)
 		}
 
-		c.JSON(resp.StatusCode, ErrorResponse{
+		details := upstreamErrorDetails(config, resp.StatusCode, []byte(errorText))
+		log.Printf("Raycast API error: %d %s", resp.StatusCode, errorText)
+		if isContextLengthError(resp.StatusCode, bodyBytes) {
+			writeError(http.StatusBadRequest, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: contextLengthMessage(model, models[modelName].ContextWindow, config.Tokenizer.CountPrompt(messageResult)),
+					Type:    "context_length_exceeded",
+					Details: details,
+				},
+			})
+			return
+		}
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			setHeader("Retry-After", retryAfter)
+		}
+		writeError(mapUpstreamStatus(resp.StatusCode), ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
 			}{
-				Message: fmt.Sprintf("Raycast API error: %d %s", resp.StatusCode, errorText),
+				Message: fmt.Sprintf("Raycast API error: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
 				Type:    "relay_error",
+				Details: details,
 			},
 		})
 		return
 	}
 
 	// Handle streaming response
-	if stream {
-		handleStreamingResponse(c, resp, model)
+	var fullText, finishReason string
+	promptTokens := config.Tokenizer.CountPrompt(messageResult)
+	if shared != nil {
+		config.StreamDeduper.Start(dedupKey, shared, resp.Body)
+		sharedStarted = true
+		done := make(chan struct{})
+		fullText, finishReason = streamEvents(c, shared.Subscribe(done), done, model, config, body.IncludeReasoning)
+	} else if stream {
+		fullText, finishReason = handleStreamingResponse(c, resp, model, config, body.IncludeReasoning)
 	} else {
-		handleNonStreamingResponse(c, resp, model)
+		fullText, finishReason = handleNonStreamingResponse(c, resp, model, config, &raycastRequest, body, cacheKey, promptTokens)
 	}
+
+	config.AuditLogger.Log(c, model, promptTokens, config.Tokenizer.Count(fullText), finishReason, false, body.Metadata)
 }
 
-// handleModels handles models endpoint
-func handleModels(c *gin.Context, config Config) {
+// preparedChat is a chat request resolved to a backing model and converted to Raycast messages
+type preparedChat struct {
+	Models      map[string]ModelCacheEntry
+	Provider    string
+	ModelName   string
+	Temperature float64
+	Messages    ConvertMessagesResult
+}
+
+// chatRequestError rejects a chat request while preparing it, each endpoint renders it in its own error format
+type chatRequestError struct {
+	Status  int
+	Message string
+}
+
+// prepareChatRequest does the preprocessing shared by the OpenAI and Anthropic endpoints: it resolves the model
+// and provider, applies the model defaults and converts the messages, trimming and flattening them as configured.
+// body.MaxTokens is set to the effective limit, and config.Tokenizer to the backing model's tokenizer.
+func prepareChatRequest(c *gin.Context, config *Config, model string, body *OpenAIChatRequest) (preparedChat, *chatRequestError) {
 	// Get models from cache or fetch them if cache is expired
-	models, err := config.ModelCache.GetModels(config)
+	models, err := config.ModelCache.GetModels(*config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+		log.Printf("Warning: Using models with possible error: %v", err)
+	}
+
+	// Route aliases to a backing model, the client still sees the requested model
+	backingModel := model
+	if config.ModelRouter != nil {
+		backingModel = config.ModelRouter.Pick(model)
+	}
+
+	// Get provider info from the models, display IDs resolve to the real model
+	provider, modelName, found := getProviderInfo(*config, config.realModelID(backingModel), models)
+	if !found && config.StrictModel {
+		return preparedChat{}, &chatRequestError{
+			Status:  http.StatusNotFound,
+			Message: fmt.Sprintf("The model '%s' does not exist", model),
+		}
+	}
+
+	// Let clients pin one of the providers serving the model
+	requestedProvider := body.Provider
+	if requestedProvider == "" {
+		requestedProvider = c.GetHeader("X-Provider")
+	}
+	if requestedProvider != "" {
+		if !modelServedBy(modelName, requestedProvider, models) {
+			return preparedChat{}, &chatRequestError{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("The model '%s' is not available from provider '%s'", model, requestedProvider),
+			}
+		}
+		provider = requestedProvider
+	}
+	log.Printf("Using provider: %s, model: %s", provider, modelName)
+	config.Tokenizer = NewTokenizer(provider, modelName)
+
+	// Describe the request on its span, the upstream call becomes a child span
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(
+		attribute.String("gen_ai.request.model", modelName),
+		attribute.String("raycast.provider", provider),
+		attribute.Bool("stream", body.Stream),
+	)
+
+	// Show which backend served the request, see writeChatCompletion and streamEvents
+	if config.Debug {
+		c.Set(providerKey, provider)
+	}
+
+	// Use the default temperature if not specified, clamping out of range values
+	temperature := 0.5
+	if body.Temperature != nil {
+		temperature = min(max(*body.Temperature, 0), 2)
+	}
+
+	// Fill in the backing model's defaults for parameters the client left out
+	if defaults, ok := config.ModelDefaults[modelName]; ok {
+		if body.Temperature == nil && defaults.Temperature != nil {
+			temperature = *defaults.Temperature
+		}
+		if resolveMaxTokens(*body) == 0 {
+			body.MaxTokens = defaults.MaxTokens
+		}
+	}
+	if resolveMaxTokens(*body) == 0 {
+		body.MaxTokens = config.DefaultMaxTokens
+	}
+
+	// Convert messages and extract system instruction
+	convertStart := time.Now()
+	messageResult := convertMessages(body.Messages, config.DefaultSystemInstruction)
+
+	// Drop the oldest turns when the conversation would overflow the model's context window
+	if contextWindow := models[modelName].ContextWindow; config.AutoTrim && contextWindow > 0 {
+		before := config.Tokenizer.CountPrompt(messageResult)
+		if trimmed := trimMessages(&messageResult, contextWindow-resolveMaxTokens(*body), config.Tokenizer); trimmed > 0 {
+			log.Printf("Trimmed %d messages (%d -> %d tokens) to fit %s context window of %d",
+				trimmed, before, config.Tokenizer.CountPrompt(messageResult), modelName, contextWindow)
+		}
+	}
+	if config.FlattenMessages || body.FlattenMessages {
+		flattenMessages(&messageResult)
+	}
+	c.Set(timingConvert, time.Since(convertStart))
+
+	return preparedChat{
+		Models:      models,
+		Provider:    provider,
+		ModelName:   modelName,
+		Temperature: temperature,
+		Messages:    messageResult,
+	}, nil
+}
+
+// handleMessages handles Anthropic messages endpoint
+func handleMessages(c *gin.Context, config Config) {
+	config = withClientScope(c, config)
+	config = withRequestTimeout(c, config)
+	// Cap the request body size to protect against oversized requests
+	if config.MaxRequestBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxRequestBytes)
+	}
+
+	var body AnthropicMessagesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, AnthropicErrorResponse{
+				Type: "error",
+				Error: struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				}{
+					Type:    "request_too_large",
+					Message: fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesErr.Limit),
+				},
+			})
+			return
+		}
+
+		c.JSON(http.StatusBadRequest, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "invalid_request_error",
+				Message: fmt.Sprintf("Invalid request body: %v", err),
+			},
+		})
+		return
+	}
+
+	if len(body.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "invalid_request_error",
+				Message: "Missing or invalid 'messages' field",
+			},
+		})
+		return
+	}
+
+	// Use default model if not specified
+	model := body.Model
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	if !config.modelAllowed(model) {
+		c.JSON(http.StatusForbidden, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "permission_error",
+				Message: fmt.Sprintf("The model '%s' is not allowed", model),
+			},
+		})
+		return
+	}
+
+	// The request takes the same path as an OpenAI one up to the upstream call
+	chatBody := OpenAIChatRequest{
+		Model:       model,
+		Messages:    convertAnthropicMessages(body),
+		Temperature: body.Temperature,
+		MaxTokens:   body.MaxTokens,
+		Provider:    body.Provider,
+		Stream:      body.Stream,
+	}
+	prepared, prepareErr := prepareChatRequest(c, &config, model, &chatBody)
+	if prepareErr != nil {
+		errorType := "invalid_request_error"
+		if prepareErr.Status == http.StatusNotFound {
+			errorType = "not_found_error"
+		}
+		c.JSON(prepareErr.Status, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    errorType,
+				Message: prepareErr.Message,
+			},
+		})
+		return
+	}
+	models, provider, modelName, messageResult := prepared.Models, prepared.Provider, prepared.ModelName, prepared.Messages
+
+	// Prepare Raycast request
+	raycastRequest := RaycastChatRequest{
+		AdditionalSystemInstructions: "",
+		Debug:                        false,
+		Locale:                       "en-US",
+		Messages:                     messageResult.RaycastMessages,
+		Model:                        modelName,
+		Provider:                     provider,
+		Source:                       config.Source,
+		SystemInstruction:            messageResult.SystemInstruction,
+		Temperature:                  prepared.Temperature,
+		MaxTokens:                    resolveMaxTokens(chatBody),
+		ThreadID:                     uuid.New().String(),
+		Tools:                        []RaycastTool{},
+	}
+
+	// Block flagged prompts before they reach Raycast, checking everything that will be sent
+	if flagged, err := config.Moderator.Check(moderationInput(raycastRequest)); err != nil {
+		c.JSON(http.StatusServiceUnavailable, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "api_error",
+				Message: "Unable to moderate the request, please retry later",
+			},
+		})
+		return
+	} else if flagged {
+		c.JSON(http.StatusBadRequest, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "invalid_request_error",
+				Message: "The request was rejected by content moderation",
+			},
+		})
+		return
+	}
+
+	// Surface the exact upstream request to help diagnose ignored parameters
+	if config.Debug {
+		c.Header("X-Raycast-Request", redactedRequestBody(config, raycastRequest))
+	}
+
+	resp, err := sendWithFallbacks(c.Request.Context(), config, &raycastRequest, chatBody, models, nil)
+	if raycastRequest.Model != modelName {
+		modelName, provider = raycastRequest.Model, raycastRequest.Provider
+		config.Tokenizer = NewTokenizer(provider, modelName)
+		if config.Debug {
+			c.Set(providerKey, provider)
+		}
+	}
+	if errors.Is(err, ErrUpstreamBusy) {
+		c.JSON(http.StatusTooManyRequests, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "rate_limit_error",
+				Message: "Too many concurrent requests, please retry later",
+			},
+		})
+		return
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		c.JSON(http.StatusServiceUnavailable, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "overloaded_error",
+				Message: "Raycast is temporarily unavailable, please retry later",
+			},
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "api_error",
+				Message: fmt.Sprintf("Error sending request to Raycast: %v", err),
+			},
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		log.Printf("Raycast API error: %d %s", resp.StatusCode, string(bodyBytes))
+		if isContextLengthError(resp.StatusCode, bodyBytes) {
+			c.JSON(http.StatusBadRequest, AnthropicErrorResponse{
+				Type: "error",
+				Error: struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				}{
+					Type:    "invalid_request_error",
+					Message: contextLengthMessage(model, models[modelName].ContextWindow, config.Tokenizer.CountPrompt(messageResult)),
+				},
+			})
+			return
+		}
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			c.Header("Retry-After", retryAfter)
+		}
+		c.JSON(mapUpstreamStatus(resp.StatusCode), AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "api_error",
+				Message: "Raycast API error, " + upstreamErrorDetails(config, resp.StatusCode, bodyBytes),
+			},
+		})
+		return
+	}
+
+	// Handle streaming response
+	var fullText, finishReason string
+	promptTokens := config.Tokenizer.CountPrompt(messageResult)
+	if body.Stream {
+		fullText, finishReason = handleAnthropicStreamingResponse(c, resp, model, config, promptTokens)
+	} else {
+		fullText, finishReason = handleAnthropicNonStreamingResponse(c, resp, model, config, promptTokens)
+	}
+
+	config.AuditLogger.Log(c, model, promptTokens, config.Tokenizer.Count(fullText), finishReason, false, nil)
+}
+
+// handleModels handles models endpoint
+func handleModels(c *gin.Context, config Config) {
+	// Optionally list only models of one type, e.g. ?type=chat
+	modelTypeFilter := c.Query("type")
+	if modelTypeFilter != "" && !slices.Contains(ModelTypes, modelTypeFilter) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
 			}{
-				Message: fmt.Sprintf("An error occurred while fetching models: %v", err),
-				Type:    "relay_error",
-				Details: err.Error(),
+				Message: fmt.Sprintf("Invalid model type %q, expected one of: %s", modelTypeFilter, strings.Join(ModelTypes, ", ")),
+				Type:    "invalid_request_error",
 			},
 		})
 		return
 	}
 
+	// Optionally page through the sorted list with ?limit= and ?after=<last model ID of the previous page>
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: fmt.Sprintf("Invalid limit %q, expected a positive integer", value),
+					Type:    "invalid_request_error",
+				},
+			})
+			return
+		}
+		limit = parsed
+	}
+	after := c.Query("after")
+	ownedBy := c.Query("owned_by")
+
+	// Get models from cache or fetch them if cache is expired.
+	// On failure GetModels still returns the default model, which is served unless in strict mode.
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		if config.StrictModel {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: fmt.Sprintf("An error occurred while fetching models: %v", err),
+					Type:    "relay_error",
+					Details: err.Error(),
+				},
+			})
+			return
+		}
+		log.Printf("Warning: Serving default models after fetch error: %v", err)
+	}
+
 	// Convert models to a slice that can be sorted
 	var modelSlice []struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		OwnedBy string `json:"owned_by"`
+		ID            string   `json:"id"`
+		Object        string   `json:"object"`
+		Created       int64    `json:"created"`
+		OwnedBy       string   `json:"owned_by"`
+		ContextWindow int      `json:"context_window,omitempty"`
+		Capabilities  []string `json:"capabilities,omitempty"`
+		Type          string   `json:"type,omitempty"`
 	}
 
+	// Include context window and capabilities only when verbose output is requested
+	verbose := c.Query("verbose") == "true"
+
 	for _, info := range models {
-		modelSlice = append(modelSlice, struct {
-			ID      string `json:"id"`
-			Object  string `json:"object"`
-			Created int64  `json:"created"`
-			OwnedBy string `json:"owned_by"`
+		if !config.modelAllowed(info.Model) {
+			continue
+		}
+		if modelTypeFilter != "" && info.Type != modelTypeFilter {
+			continue
+		}
+		if ownedBy != "" && !strings.EqualFold(providerOwner(info.Provider), ownedBy) {
+			continue
+		}
+		if after != "" && config.displayModelID(info.Model) <= after {
+			continue
+		}
+
+		entry := struct {
+			ID            string   `json:"id"`
+			Object        string   `json:"object"`
+			Created       int64    `json:"created"`
+			OwnedBy       string   `json:"owned_by"`
+			ContextWindow int      `json:"context_window,omitempty"`
+			Capabilities  []string `json:"capabilities,omitempty"`
+			Type          string   `json:"type,omitempty"`
 		}{
-			ID:      info.Model,
+			ID:      config.displayModelID(info.Model),
 			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: info.Provider,
-		})
+			Created: modelCreated(info.Model),
+			OwnedBy: providerOwner(info.Provider),
+		}
+		if verbose {
+			entry.ContextWindow = info.ContextWindow
+			entry.Capabilities = info.Capabilities
+			entry.Type = info.Type
+		}
+		modelSlice = append(modelSlice, entry)
 	}
 
 	// Sort by ID
@@ -248,10 +921,16 @@ func handleModels(c *gin.Context, config Config) {
 		return modelSlice[i].ID < modelSlice[j].ID
 	})
 
+	hasMore := limit > 0 && len(modelSlice) > limit
+	if hasMore {
+		modelSlice = modelSlice[:limit]
+	}
+
 	// Create OpenAI format response
 	openaiModels := OpenAIModelResponse{
-		Object: "list",
-		Data:   modelSlice,
+		Object:  "list",
+		Data:    modelSlice,
+		HasMore: hasMore,
 	}
 
 	jsonData, err := json.MarshalIndent(openaiModels, "", "  ")
@@ -273,11 +952,52 @@ func handleModels(c *gin.Context, config Config) {
 	// Add newline to the end of JSON data
 	jsonData = append(jsonData, '\n')
 
+	// Let polling clients skip unchanged lists, the ETag changes whenever the listed models do
+	etag := listETag(jsonData)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
 	// Set content type and write formatted JSON
 	c.Header("Content-Type", "application/json")
 	c.Writer.Write(jsonData)
 }
 
+// handleProviders lists the providers of the available models with their model counts
+func handleProviders(c *gin.Context, config Config) {
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		log.Printf("Warning: Listing providers of default models after fetch error: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, info := range models {
+		if config.modelAllowed(info.Model) {
+			counts[info.Provider]++
+		}
+	}
+
+	type providerEntry struct {
+		ID         string `json:"id"`
+		Object     string `json:"object"`
+		ModelCount int    `json:"model_count"`
+	}
+	providers := make([]providerEntry, 0, len(counts))
+	for provider, count := range counts {
+		providers = append(providers, providerEntry{ID: provider, Object: "provider", ModelCount: count})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].ID < providers[j].ID
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   providers,
+	})
+}
+
 // handleRefreshModels handles manual refresh of the model cache
 func handleRefreshModels(c *gin.Context, config Config) {
 	config.ModelCache.ForceCacheRefresh(config)
@@ -286,3 +1006,90 @@ func handleRefreshModels(c *gin.Context, config Config) {
 		"message": "Model cache refreshed",
 	})
 }
+
+// handleUsage returns the Raycast quota usage, or 501 when no usage endpoint is configured
+func handleUsage(c *gin.Context, config Config) {
+	if config.UsageURL == "" {
+		c.JSON(http.StatusNotImplemented, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: "Usage reporting is not available, set RAYCAST_USAGE_URL to enable it",
+				Type:    "not_implemented",
+			},
+		})
+		return
+	}
+
+	usage, err := fetchUsage(config)
+	if err != nil {
+		log.Printf("Error fetching usage: %v", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{
+			Error: struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Details string `json:"details,omitempty"`
+			}{
+				Message: "Error fetching usage from Raycast",
+				Type:    "server_error",
+				Details: err.Error(),
+			},
+		})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// handleAdminCache returns the current state of the model cache
+func handleAdminCache(c *gin.Context, config Config) {
+	modelIDs, expiresAt := config.ModelCache.State()
+	c.JSON(http.StatusOK, gin.H{
+		"count":      len(modelIDs),
+		"expires_at": expiresAt.Format(time.RFC3339),
+		"expired":    !time.Now().Before(expiresAt),
+		"models":     modelIDs,
+	})
+}
+
+// handleAdminDrain marks the proxy as not ready so load balancers stop routing new traffic to it.
+// In-flight and new requests are still served until the process receives SIGTERM.
+func handleAdminDrain(c *gin.Context, config Config) {
+	config.Draining.Store(true)
+	log.Println("Draining, readiness probe now reports not ready")
+	c.JSON(http.StatusOK, gin.H{"status": "draining"})
+}
+
+// handleReady reports whether the proxy should receive traffic
+func handleReady(c *gin.Context, config Config) {
+	if config.Draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// handleVersion reports the build version, commit and date
+func handleVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, BuildInfo())
+}
+
+// handleHealth reports liveness along with build and cache details
+func handleHealth(c *gin.Context, config Config) {
+	modelIDs, _ := config.ModelCache.State()
+
+	var lastModelFetch *string
+	if fetchedAt := config.ModelCache.LastFetched(); !fetchedAt.IsZero() {
+		formatted := fetchedAt.Format(time.RFC3339)
+		lastModelFetch = &formatted
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":           "ok",
+		"version":          Version,
+		"uptime_seconds":   int64(time.Since(startTime).Seconds()),
+		"cached_models":    len(modelIDs),
+		"last_model_fetch": lastModelFetch,
+	})
+}
@@ -0,0 +1,466 @@
+package service
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDefaultMaxTokens(t *testing.T) {
+	tests := []struct {
+		name             string
+		defaultMaxTokens int
+		body             string
+		want             int
+	}{
+		{"unset by default", 0, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, 0},
+		{"configured default", 4096, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, 4096},
+		{"client value wins", 4096, `{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent int
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				sent = req.MaxTokens
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.DefaultMaxTokens = tt.defaultMaxTokens
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if sent != tt.want {
+				t.Fatalf("expected max_tokens %d upstream, got %d", tt.want, sent)
+			}
+		})
+	}
+}
+
+func TestRaycastSource(t *testing.T) {
+	for _, source := range []string{"", "raycast_extension"} {
+		var sent string
+		upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+			sent = req.Source
+			writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+		})
+		config := newTestConfig(upstream.URL)
+		config.Source = source
+
+		doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+		want := source
+		if want == "" {
+			want = DefaultSource
+		}
+		if sent != want {
+			t.Fatalf("expected source %q in the Raycast request, got %q", want, sent)
+		}
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		defaults  *float64
+		want      float64
+		cacheable bool
+	}{
+		{"omitted", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, nil, 0.5, false},
+		{"explicit zero", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"Hi"}]}`, nil, 0, true},
+		{"explicit value", `{"model":"gpt-4o","temperature":1.2,"messages":[{"role":"user","content":"Hi"}]}`, nil, 1.2, false},
+		{"clamped", `{"model":"gpt-4o","temperature":3,"messages":[{"role":"user","content":"Hi"}]}`, nil, 2, false},
+		{"model default zero", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, new(float64), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []float64
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				sent = append(sent, req.Temperature)
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.ResponseCache = NewResponseCache(10)
+			if tt.defaults != nil {
+				config.ModelDefaults = map[string]ModelDefaults{"gpt-4o": {Temperature: tt.defaults}}
+			}
+			router := Router(&config)
+
+			for i := 0; i < 2; i++ {
+				if w := doRequest(router, http.MethodPost, "/v1/chat/completions", tt.body); w.Code != http.StatusOK {
+					t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+				}
+			}
+			if sent[0] != tt.want {
+				t.Fatalf("expected temperature %v upstream, got %v", tt.want, sent[0])
+			}
+			// Only an effective temperature of 0 makes the answer cacheable
+			if cached := len(sent) == 1; cached != tt.cacheable {
+				t.Fatalf("expected cacheable %v, upstream was called %d times", tt.cacheable, len(sent))
+			}
+		})
+	}
+}
+
+func TestCompressedCompletion(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", "gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"gzip;q=0, deflate", "deflate", func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }},
+		{"gzip;q=0", "", func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.EnableCompression = true
+	router := Router(&config)
+
+	for _, tt := range tests {
+		w := doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+			"Accept-Encoding", tt.acceptEncoding)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tt.encoding {
+			t.Fatalf("%s: expected Content-Encoding %q, got %q", tt.acceptEncoding, tt.encoding, encoding)
+		}
+		reader, err := tt.decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var completion OpenAIChatResponse
+		if err := json.NewDecoder(reader).Decode(&completion); err != nil || completion.Choices[0].Message.Content != "Hi" {
+			t.Fatalf("%s: could not decode the completion: %v", tt.acceptEncoding, err)
+		}
+	}
+}
+
+func TestEmptyCompletionFinishReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []RaycastSSEData
+		want   string
+	}{
+		{"stop", []RaycastSSEData{{FinishReason: "stop"}}, "stop"},
+		{"filtered", []RaycastSSEData{{FinishReason: "safety"}}, "content_filter"},
+		{"unknown reason", []RaycastSSEData{{FinishReason: "blocked"}}, "content_filter"},
+		{"length", []RaycastSSEData{{FinishReason: "length"}}, "content_filter"},
+		{"max tokens", []RaycastSSEData{{FinishReason: "max_tokens"}}, "content_filter"},
+		// Reasoning used up the token limit before the answer started, which is a genuine length cut
+		{"length after reasoning", []RaycastSSEData{{Reasoning: "Thinking"}, {FinishReason: "length"}}, "length"},
+		{"length with text", []RaycastSSEData{{Text: "Hi"}, {FinishReason: "length"}}, "length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				for _, event := range tt.events {
+					writeSSE(w, event)
+				}
+			})
+			config := newTestConfig(upstream.URL)
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if reason := decodeCompletion(t, w.Body).Choices[0].FinishReason; reason != tt.want {
+				t.Fatalf("expected finish reason %q, got %q", tt.want, reason)
+			}
+		})
+	}
+}
+
+func TestSystemInstructions(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		system     string
+		additional string
+	}{
+		{"neither", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, "", ""},
+		{"system message only", `{"model":"gpt-4o","messages":[{"role":"system","content":"Be a pirate"},{"role":"user","content":"Hi"}]}`, "Be a pirate", ""},
+		{"additional only", `{"model":"gpt-4o","additional_system_instructions":"Answer in French","messages":[{"role":"user","content":"Hi"}]}`, "", "Answer in French"},
+		{"both", `{"model":"gpt-4o","additional_system_instructions":"Answer in French","messages":[{"role":"system","content":[{"type":"text","text":"Be a pirate"}]},{"role":"user","content":"Hi"}]}`, "Be a pirate", "Answer in French"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent RaycastChatRequest
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				sent = req
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+
+			if w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", tt.body); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if sent.SystemInstruction != tt.system || sent.AdditionalSystemInstructions != tt.additional {
+				t.Fatalf("expected system %q and additional %q, got %q and %q",
+					tt.system, tt.additional, sent.SystemInstruction, sent.AdditionalSystemInstructions)
+			}
+			// The system message never leaks into the conversation
+			for _, message := range sent.Messages {
+				if message.Content.Text != "Hi" {
+					t.Fatalf("unexpected message %q", message.Content.Text)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		upstream int
+		want     int
+	}{
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.upstream), func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(tt.upstream)
+				w.Write([]byte("<html>error page</html>"))
+			})
+			config := newTestConfig(upstream.URL)
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			var errorResponse ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &errorResponse); err != nil || errorResponse.Error.Type != "relay_error" {
+				t.Fatalf("expected an OpenAI error envelope, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMessagesSharesChatPreprocessing(t *testing.T) {
+	zero := 0.0
+	tests := []struct {
+		name      string
+		configure func(config *Config)
+		body      string
+		check     func(t *testing.T, tried []RaycastChatRequest)
+	}{
+		{
+			name: "model defaults",
+			configure: func(config *Config) {
+				config.ModelDefaults = map[string]ModelDefaults{"gpt-4o": {Temperature: &zero, MaxTokens: 77}}
+			},
+			body: `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+			check: func(t *testing.T, tried []RaycastChatRequest) {
+				if tried[0].Temperature != 0 || tried[0].MaxTokens != 77 {
+					t.Fatalf("expected the model defaults, got temperature %v and max_tokens %d", tried[0].Temperature, tried[0].MaxTokens)
+				}
+			},
+		},
+		{
+			name:      "default max tokens",
+			configure: func(config *Config) { config.DefaultMaxTokens = 512 },
+			body:      `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+			check: func(t *testing.T, tried []RaycastChatRequest) {
+				if tried[0].MaxTokens != 512 {
+					t.Fatalf("expected DEFAULT_MAX_TOKENS, got %d", tried[0].MaxTokens)
+				}
+			},
+		},
+		{
+			name:      "provider in the body",
+			configure: func(config *Config) {},
+			body:      `{"model":"gpt-4o","max_tokens":10,"provider":"azure_openai","messages":[{"role":"user","content":"Hi"}]}`,
+			check: func(t *testing.T, tried []RaycastChatRequest) {
+				if tried[0].Provider != "azure_openai" {
+					t.Fatalf("expected the pinned provider, got %s", tried[0].Provider)
+				}
+			},
+		},
+		{
+			name:      "auto trim",
+			configure: func(config *Config) { config.AutoTrim = true },
+			body:      `{"model":"gpt-4o","max_tokens":127990,"messages":[{"role":"user","content":"` + strings.Repeat("old ", 100) + `"},{"role":"assistant","content":"Ok"},{"role":"user","content":"Hi"}]}`,
+			check: func(t *testing.T, tried []RaycastChatRequest) {
+				if len(tried[0].Messages) != 1 || tried[0].Messages[0].Content.Text != "Hi" {
+					t.Fatalf("expected only the last turn to be kept, got %d messages", len(tried[0].Messages))
+				}
+			},
+		},
+		{
+			name: "fallbacks",
+			configure: func(config *Config) {
+				config.ModelFallbacks = map[string][]string{"gpt-4o": {"claude-sonnet"}}
+			},
+			body: `{"model":"gpt-4o","max_tokens":10,"messages":[{"role":"user","content":"fail"}]}`,
+			check: func(t *testing.T, tried []RaycastChatRequest) {
+				if len(tried) != 2 || tried[1].Model != "claude-sonnet" {
+					t.Fatalf("expected a fallback to claude-sonnet, got %d requests", len(tried))
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tried []RaycastChatRequest
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				tried = append(tried, req)
+				if req.Model == "gpt-4o" && req.Messages[len(req.Messages)-1].Content.Text == "fail" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			tt.configure(&config)
+
+			if w := doRequest(Router(&config), http.MethodPost, "/v1/messages", tt.body); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			tt.check(t, tried)
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		stream bool
+	}{
+		{"non-streaming", `{"model":"gpt-4o","messages":[{"role":"user","content":"first"},{"role":"assistant","content":"ok"},{"role":"user","content":"echo me"}]}`, false},
+		{"streaming", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"first"},{"role":"assistant","content":"ok"},{"role":"user","content":"echo me"}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				called = true
+				writeSSE(w, RaycastSSEData{Text: "from upstream"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.DryRun = true
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if called {
+				t.Fatal("expected dry run not to contact Raycast")
+			}
+
+			var text string
+			if tt.stream {
+				text = streamedText(t, w.Body)
+			} else {
+				text = decodeCompletion(t, w.Body).Choices[0].Message.Content
+			}
+			if text != "echo me" {
+				t.Fatalf("expected the last user message echoed, got %q", text)
+			}
+		})
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	large := `{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"` + strings.Repeat("a", 2048) + `"}]}`
+	small := `{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`
+	tests := []struct {
+		name      string
+		path      string
+		limit     int64
+		body      string
+		want      int
+		errorType string
+	}{
+		{"chat over the limit", "/v1/chat/completions", 1024, large, http.StatusRequestEntityTooLarge, "invalid_request_error"},
+		{"chat under the limit", "/v1/chat/completions", 1024, small, http.StatusOK, ""},
+		{"chat without a limit", "/v1/chat/completions", 0, large, http.StatusOK, ""},
+		{"messages over the limit", "/v1/messages", 1024, large, http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"messages under the limit", "/v1/messages", 1024, small, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.MaxRequestBytes = tt.limit
+
+			w := doRequest(Router(&config), http.MethodPost, tt.path, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.errorType == "" {
+				return
+			}
+			// Both the OpenAI and the Anthropic error envelopes carry error.type and error.message
+			var resp struct {
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode error response: %v", err)
+			}
+			if resp.Error.Type != tt.errorType || !strings.Contains(resp.Error.Message, "1024 bytes") {
+				t.Fatalf("expected a %s error naming the limit, got %+v", tt.errorType, resp.Error)
+			}
+		})
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		strict bool
+		want   int
+		field  string
+	}{
+		{"temperature in range", `"temperature":2`, true, http.StatusOK, ""},
+		{"temperature too high", `"temperature":2.5`, true, http.StatusBadRequest, "temperature"},
+		{"temperature negative", `"temperature":-0.1`, true, http.StatusBadRequest, "temperature"},
+		{"top_p in range", `"top_p":1`, true, http.StatusOK, ""},
+		{"top_p too high", `"top_p":1.5`, true, http.StatusBadRequest, "top_p"},
+		{"presence_penalty in range", `"presence_penalty":-2`, true, http.StatusOK, ""},
+		{"presence_penalty too low", `"presence_penalty":-2.5`, true, http.StatusBadRequest, "presence_penalty"},
+		{"frequency_penalty too high", `"frequency_penalty":3`, true, http.StatusBadRequest, "frequency_penalty"},
+		{"n in range", `"n":1`, true, http.StatusOK, ""},
+		{"n too low", `"n":0`, true, http.StatusBadRequest, "n"},
+		{"clamped without strict mode", `"temperature":2.5,"top_p":1.5`, false, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+			})
+			config := newTestConfig(upstream.URL)
+			config.StrictParams = tt.strict
+
+			body := `{"model":"gpt-4o",` + tt.params + `,"messages":[{"role":"user","content":"Hi"}]}`
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", body)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.field == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode error response: %v", err)
+			}
+			if resp.Error.Type != "invalid_request_error" || !strings.Contains(resp.Error.Message, "'"+tt.field+"'") {
+				t.Fatalf("expected an invalid_request_error naming '%s', got %+v", tt.field, resp.Error)
+			}
+		})
+	}
+}
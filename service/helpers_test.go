@@ -0,0 +1,97 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testModels is the model list served by newTestUpstream
+const testModels = `{"models":[
+	{"model":"gpt-4o","provider":"openai","context":128000},
+	{"model":"gpt-4o","provider":"azure_openai","context":128000},
+	{"model":"claude-sonnet","provider":"anthropic","context":200000}
+]}`
+
+// newTestConfig returns a config sending chat requests to apiURL with every optional feature disabled
+func newTestConfig(apiURL string) Config {
+	return Config{
+		RaycastBearerToken: "test-token",
+		APIURLs:            []string{apiURL},
+		ModelsURLs:         []string{apiURL + "/models"},
+		ModelCache:         NewModelCache(),
+		ModelCacheTTL:      time.Hour,
+		HTTPClient:         &http.Client{},
+		ModelsClient:       &http.Client{Timeout: time.Second},
+	}
+}
+
+// newTestUpstream starts a fake Raycast API serving testModels and passing chat requests to chat
+func newTestUpstream(t *testing.T, chat func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest)) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, testModels)
+			return
+		}
+
+		var req RaycastChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("upstream received an invalid request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		chat(w, r, req)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// writeSSE writes Raycast SSE events, each value encoded as one data line
+func writeSSE(w http.ResponseWriter, events ...interface{}) {
+	for _, event := range events {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// doRequest sends a request with a JSON body to the router and returns the recorded response
+func doRequest(router http.Handler, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// decodeCompletion decodes a non-streaming chat completion response
+func decodeCompletion(t *testing.T, body *bytes.Buffer) OpenAIChatResponse {
+	t.Helper()
+	var completion OpenAIChatResponse
+	if err := json.Unmarshal(body.Bytes(), &completion); err != nil {
+		t.Fatalf("invalid completion %q: %v", body.String(), err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("expected one choice, got %q", body.String())
+	}
+	return completion
+}
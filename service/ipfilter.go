@@ -0,0 +1,134 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 16:40:52
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 16:40:52
+ * @FilePath: /raycast2api/service/ipfilter.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IPFilter allows or denies clients by address
+type IPFilter struct {
+	allow []*net.IPNet // Empty allows every address not denied
+	deny  []*net.IPNet
+}
+
+// NewIPFilter creates an IP filter from comma-separated lists of CIDRs or single addresses
+func NewIPFilter(allowlist string, denylist string) (*IPFilter, error) {
+	allow, err := parseCIDRList(allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %w", err)
+	}
+	deny, err := parseCIDRList(denylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %w", err)
+	}
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether a client address may use the proxy. A nil filter allows everything.
+func (f *IPFilter) Allowed(address string) bool {
+	if f == nil {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// IPRateLimiter limits requests per client address within fixed one-minute windows
+type IPRateLimiter struct {
+	limit       int
+	windowStart time.Time
+	counts      map[string]int
+	mutex       sync.Mutex
+}
+
+// NewIPRateLimiter creates a rate limiter allowing limit requests per address per minute
+func NewIPRateLimiter(limit int) *IPRateLimiter {
+	return &IPRateLimiter{
+		limit:       limit,
+		windowStart: time.Now(),
+		counts:      make(map[string]int),
+	}
+}
+
+// Allow records a request from address and reports whether it is within the limit.
+// A nil limiter allows everything.
+func (rl *IPRateLimiter) Allow(address string) bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// Start a new window, which also forgets addresses that have gone quiet
+	if time.Since(rl.windowStart) >= time.Minute {
+		rl.windowStart = time.Now()
+		rl.counts = make(map[string]int)
+	}
+
+	rl.counts[address]++
+	return rl.counts[address] <= rl.limit
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs, treating bare addresses as single hosts
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether any of the networks contains ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
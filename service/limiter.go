@@ -0,0 +1,140 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 15:02:11
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 15:02:11
+ * @FilePath: /raycast2api/service/limiter.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// QueueFeedbackInterval is how often a queued request is told its position
+const QueueFeedbackInterval = 2 * time.Second
+
+// ErrUpstreamBusy is returned when the concurrency limit is reached and overflow requests are rejected
+var ErrUpstreamBusy = errors.New("too many concurrent requests to raycast")
+
+// UpstreamLimiter bounds the number of in-flight Raycast requests with a semaphore.
+// A request holds its slot until the response body is closed, so streams count for their whole duration.
+type UpstreamLimiter struct {
+	slots  chan struct{}
+	reject bool // Reject instead of queueing when all slots are taken
+
+	// Waiters are numbered as they arrive, so a waiter's position is its number minus those that left before it
+	queueMutex sync.Mutex
+	enqueued   int
+	dequeued   int
+}
+
+// NewUpstreamLimiter creates a limiter allowing at most max concurrent requests
+func NewUpstreamLimiter(max int, reject bool) *UpstreamLimiter {
+	return &UpstreamLimiter{
+		slots:  make(chan struct{}, max),
+		reject: reject,
+	}
+}
+
+// Acquire takes a slot, waiting for one until ctx is done unless overflow requests are rejected.
+// While waiting, notify (if set) is called with the queue position right away and then every QueueFeedbackInterval.
+// It reports whether a slot was taken. A nil limiter always succeeds.
+func (ul *UpstreamLimiter) Acquire(ctx context.Context, notify func(position int)) bool {
+	if ul == nil {
+		return true
+	}
+
+	if ul.reject {
+		select {
+		case ul.slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case ul.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if notify == nil {
+		select {
+		case ul.slots <- struct{}{}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	ul.queueMutex.Lock()
+	ul.enqueued++
+	ticket := ul.enqueued
+	ul.queueMutex.Unlock()
+	defer func() {
+		ul.queueMutex.Lock()
+		ul.dequeued++
+		ul.queueMutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(QueueFeedbackInterval)
+	defer ticker.Stop()
+	notify(ul.position(ticket))
+	for {
+		select {
+		case ul.slots <- struct{}{}:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			notify(ul.position(ticket))
+		}
+	}
+}
+
+// position returns the approximate queue position of a waiter, starting at 1
+func (ul *UpstreamLimiter) position(ticket int) int {
+	ul.queueMutex.Lock()
+	defer ul.queueMutex.Unlock()
+	return max(ticket-ul.dequeued, 1)
+}
+
+// Release frees a slot taken by Acquire
+func (ul *UpstreamLimiter) Release() {
+	if ul == nil {
+		return
+	}
+	<-ul.slots
+}
+
+// ReleaseOnClose wraps a response body so the slot is freed when the body is closed
+func (ul *UpstreamLimiter) ReleaseOnClose(body io.ReadCloser) io.ReadCloser {
+	if ul == nil {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, release: ul.Release}
+}
+
+// limitedBody releases its limiter slot the first time it is closed
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+// Close closes the body and releases the slot
+func (lb *limitedBody) Close() error {
+	err := lb.ReadCloser.Close()
+	lb.once.Do(lb.release)
+	return err
+}
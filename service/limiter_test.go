@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLimiterRejects(t *testing.T) {
+	limiter := NewUpstreamLimiter(1, true)
+
+	if !limiter.Acquire(context.Background(), nil) {
+		t.Fatal("first request was rejected")
+	}
+	if limiter.Acquire(context.Background(), nil) {
+		t.Fatal("request over the limit was not rejected")
+	}
+	limiter.Release()
+	if !limiter.Acquire(context.Background(), nil) {
+		t.Fatal("request after a release was rejected")
+	}
+}
+
+func TestUpstreamLimiterQueues(t *testing.T) {
+	limiter := NewUpstreamLimiter(1, false)
+	limiter.Acquire(context.Background(), nil)
+
+	positions := make(chan int, 10)
+	acquired := make(chan bool)
+	go func() {
+		acquired <- limiter.Acquire(context.Background(), func(position int) { positions <- position })
+	}()
+
+	select {
+	case position := <-positions:
+		if position != 1 {
+			t.Fatalf("expected queue position 1, got %d", position)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request was not told its position")
+	}
+	select {
+	case <-acquired:
+		t.Fatal("queued request got a slot while it was taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	limiter.Release()
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("queued request failed to acquire")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request did not get the released slot")
+	}
+}
+
+func TestUpstreamLimiterReleaseOnClose(t *testing.T) {
+	limiter := NewUpstreamLimiter(1, true)
+	limiter.Acquire(context.Background(), nil)
+
+	body := limiter.ReleaseOnClose(io.NopCloser(strings.NewReader("")))
+	body.Close()
+	body.Close() // A second close must not free another slot
+
+	if !limiter.Acquire(context.Background(), nil) {
+		t.Fatal("closing the body did not release the slot")
+	}
+	if limiter.Acquire(context.Background(), nil) {
+		t.Fatal("closing the body twice released two slots")
+	}
+}
+
+func TestNilUpstreamLimiter(t *testing.T) {
+	var limiter *UpstreamLimiter
+	if !limiter.Acquire(context.Background(), nil) {
+		t.Fatal("nil limiter rejected a request")
+	}
+	limiter.Release()
+}
+
+func TestChatCompletionRejectedWhenBusy(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.UpstreamLimiter = NewUpstreamLimiter(1, true)
+	router := Router(&config)
+	request := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`
+
+	config.UpstreamLimiter.Acquire(context.Background(), nil)
+	if w := doRequest(router, http.MethodPost, "/v1/chat/completions", request); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while the limit is reached, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A finished request frees its slot for the next one
+	config.UpstreamLimiter.Release()
+	for i := 0; i < 2; i++ {
+		if w := doRequest(router, http.MethodPost, "/v1/chat/completions", request); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUpstreamLimiterQueueCancelled(t *testing.T) {
+	limiter := NewUpstreamLimiter(1, false)
+	limiter.Acquire(context.Background(), nil)
+
+	for _, notify := range []func(position int){nil, func(position int) {}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		acquired := make(chan bool)
+		go func() { acquired <- limiter.Acquire(ctx, notify) }()
+		cancel()
+
+		select {
+		case ok := <-acquired:
+			if ok {
+				t.Fatal("cancelled request took a slot while it was taken")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("cancelled request kept waiting for a slot")
+		}
+	}
+}
+
+// startQueuedStream takes the only limiter slot and starts a streaming request that has to queue for it.
+// It returns the response once the first queue position comment has arrived.
+func startQueuedStream(t *testing.T, config Config) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	config.UpstreamLimiter = NewUpstreamLimiter(1, false)
+	config.QueueFeedback = true
+	config.Debug = true
+	server := httptest.NewServer(Router(&config))
+	t.Cleanup(server.Close)
+
+	config.UpstreamLimiter.Acquire(context.Background(), nil)
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != ": queued position=1\n" {
+		t.Fatalf("expected a queue position comment first, got %q (%v)", line, err)
+	}
+	config.UpstreamLimiter.Release()
+	return resp, reader
+}
+
+func TestQueuedStreamFeedback(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	resp, reader := startQueuedStream(t, newTestConfig(upstream.URL))
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rest), `"content":"Hi"`) {
+		t.Fatalf("expected the content after the queue comment, got %q", rest)
+	}
+	// Headers decided after the stream started arrive as trailers
+	if resp.Trailer.Get("X-Served-Model") != "gpt-4o" || resp.Trailer.Get("X-Upstream-Latency-Ms") == "" {
+		t.Fatalf("expected the debug headers as trailers, got %v", resp.Trailer)
+	}
+}
+
+func TestQueuedStreamUpstreamError(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"maximum context length exceeded"}`)
+	})
+	_, reader := startQueuedStream(t, newTestConfig(upstream.URL))
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The error event carries the body the status mapping would have sent
+	if !strings.Contains(string(rest), `"type":"context_length_exceeded"`) || !strings.HasSuffix(string(rest), "data: [DONE]\n\n") {
+		t.Fatalf("expected a mapped error event, got %q", rest)
+	}
+}
@@ -13,11 +13,18 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -55,21 +62,17 @@ func (mc *ModelCache) GetModels(config Config) (map[string]ModelCacheEntry, erro
 			return mc.models, nil
 		}
 
-		// If no cached models, create a default entry
-		defaultModels := map[string]ModelCacheEntry{
-			DefaultModel: {
-				Provider: DefaultProvider,
-				Model:    DefaultModel,
-			},
-		}
-		return defaultModels, err
+		// If no cached models, create an entry for the configured default model
+		entry := defaultModelEntry(config)
+		return map[string]ModelCacheEntry{entry.Model: entry}, err
 	}
 
 	// Update the cache with new data
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
 	mc.models = models
-	mc.expiresAt = time.Now().Add(ModelCacheTTL)
+	mc.fetchedAt = time.Now()
+	mc.expiresAt = mc.fetchedAt.Add(config.ModelCacheTTL)
 	log.Printf("Model cache updated with %d models, expires at %v", len(models), mc.expiresAt)
 
 	return models, nil
@@ -85,23 +88,32 @@ func (mc *ModelCache) ForceCacheRefresh(config Config) {
 	_, _ = mc.GetModels(config)
 }
 
-// fetchModelsFromAPI fetches model information from Raycast API
-func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
-	log.Println("Fetching models from Raycast API...")
+// State returns the cached model IDs (sorted) and when the cache expires
+func (mc *ModelCache) State() ([]string, time.Time) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	req, err := http.NewRequest("GET", RaycastModelsURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+	modelIDs := make([]string, 0, len(mc.models))
+	for id := range mc.models {
+		modelIDs = append(modelIDs, id)
 	}
+	sort.Strings(modelIDs)
 
-	for key, value := range getRaycastHeaders(config) {
-		req.Header.Set(key, value)
-	}
+	return modelIDs, mc.expiresAt
+}
+
+// LastFetched returns when models were last fetched successfully, or the zero time if never
+func (mc *ModelCache) LastFetched() time.Time {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	return mc.fetchedAt
+}
+
+// fetchModelsFromAPI fetches model information from Raycast API
+func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
+	log.Println("Fetching models from Raycast API...")
 
-	resp, err := client.Do(req)
+	resp, err := doWithFailover(context.Background(), config, config.ModelsClient, "GET", config.ModelsURLs, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching models: %w", err)
 	}
@@ -109,7 +121,7 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("raycast api error: %d %s", resp.StatusCode, string(bodyBytes))
+		return nil, fmt.Errorf("raycast api error, %s", upstreamErrorDetails(config, resp.StatusCode, bodyBytes))
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -123,8 +135,11 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 
 	var response struct {
 		Models []struct {
-			Provider string `json:"provider"`
-			Model    string `json:"model"`
+			Provider     string                 `json:"provider"`
+			Model        string                 `json:"model"`
+			Context      int                    `json:"context"`
+			Type         string                 `json:"type"`
+			Capabilities map[string]interface{} `json:"capabilities"`
 		} `json:"models"`
 	}
 
@@ -134,9 +149,23 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 
 	models := make(map[string]ModelCacheEntry)
 	for _, model := range response.Models {
+		// The same model may be offered by several providers, the first one listed stays the default
+		if existing, ok := models[model.Model]; ok {
+			if !slices.Contains(existing.Providers, model.Provider) {
+				existing.Providers = append(existing.Providers, model.Provider)
+				models[model.Model] = existing
+			}
+			continue
+		}
+
+		capabilities := capabilityFlags(model.Capabilities)
 		models[model.Model] = ModelCacheEntry{
-			Provider: model.Provider,
-			Model:    model.Model,
+			Provider:      model.Provider,
+			Model:         model.Model,
+			ContextWindow: model.Context,
+			Capabilities:  capabilities,
+			Type:          modelType(model.Type, capabilities),
+			Providers:     []string{model.Provider},
 		}
 	}
 
@@ -144,11 +173,311 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 	return models, nil
 }
 
-// getProviderInfo gets provider info for a model
-func getProviderInfo(modelID string, models map[string]ModelCacheEntry) (string, string) {
+// parseModelsDisplayMap parses a map of model IDs to the IDs shown to clients.
+// The spec has the form "claude-3-7-sonnet-latest=claude-3.7,gpt-4o-mini=mini".
+func parseModelsDisplayMap(spec string) (map[string]string, error) {
+	displayMap := make(map[string]string)
+	displayed := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		model, display, ok := strings.Cut(entry, "=")
+		model, display = strings.TrimSpace(model), strings.TrimSpace(display)
+		if !ok || model == "" || display == "" {
+			return nil, fmt.Errorf("display mapping %q must have the form model=display", entry)
+		}
+		if displayed[display] {
+			return nil, fmt.Errorf("display ID %q is used for more than one model", display)
+		}
+		displayMap[model] = display
+		displayed[display] = true
+	}
+	return displayMap, nil
+}
+
+// parseModelFallbacks parses the models to try, in order, when a model fails.
+// The spec has the form "modelA=modelB,modelC", with multiple models separated by ";".
+func parseModelFallbacks(spec string) (map[string][]string, error) {
+	fallbacks := make(map[string][]string)
+
+	for _, modelSpec := range strings.Split(spec, ";") {
+		modelSpec = strings.TrimSpace(modelSpec)
+		if modelSpec == "" {
+			continue
+		}
+
+		model, targets, ok := strings.Cut(modelSpec, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("fallback %q must have the form model=fallback1,fallback2", modelSpec)
+		}
+		for _, target := range strings.Split(targets, ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				fallbacks[model] = append(fallbacks[model], target)
+			}
+		}
+		if len(fallbacks[model]) == 0 {
+			return nil, fmt.Errorf("fallback %q for %s lists no models", modelSpec, model)
+		}
+	}
+	return fallbacks, nil
+}
+
+// displayModelID returns the ID clients see for a model
+func (config Config) displayModelID(modelID string) string {
+	if display, ok := config.ModelsDisplayMap[modelID]; ok {
+		return display
+	}
+	return modelID
+}
+
+// realModelID resolves a display ID back to the model ID used upstream. Other IDs are returned unchanged.
+func (config Config) realModelID(modelID string) string {
+	for model, display := range config.ModelsDisplayMap {
+		if display == modelID {
+			return model
+		}
+	}
+	return modelID
+}
+
+// parseModelDefaults parses per-model default parameters.
+// The spec has the form "model:temperature=0.2,max_tokens=8192", with multiple models separated by ";".
+func parseModelDefaults(spec string) (map[string]ModelDefaults, error) {
+	defaults := make(map[string]ModelDefaults)
+
+	for _, modelSpec := range strings.Split(spec, ";") {
+		modelSpec = strings.TrimSpace(modelSpec)
+		if modelSpec == "" {
+			continue
+		}
+
+		model, params, ok := strings.Cut(modelSpec, ":")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("defaults %q must have the form model:param=value", modelSpec)
+		}
+
+		var modelDefaults ModelDefaults
+		for _, param := range strings.Split(params, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok {
+				return nil, fmt.Errorf("default %q for %s must have the form param=value", param, model)
+			}
+			value = strings.TrimSpace(value)
+
+			switch strings.TrimSpace(name) {
+			case "temperature":
+				temperature, err := strconv.ParseFloat(value, 64)
+				if err != nil || temperature < 0 || temperature > 2 {
+					return nil, fmt.Errorf("temperature %q for %s must be a number between 0 and 2", value, model)
+				}
+				modelDefaults.Temperature = &temperature
+			case "max_tokens":
+				maxTokens, err := strconv.Atoi(value)
+				if err != nil || maxTokens <= 0 {
+					return nil, fmt.Errorf("max_tokens %q for %s must be a positive integer", value, model)
+				}
+				modelDefaults.MaxTokens = maxTokens
+			default:
+				return nil, fmt.Errorf("unknown default %q for %s, expected temperature or max_tokens", name, model)
+			}
+		}
+		defaults[model] = modelDefaults
+	}
+
+	return defaults, nil
+}
+
+// NewModelRouter creates a model router from a route spec.
+// The spec has the form "alias:modelA=70,modelB=30", with multiple aliases separated by ";".
+func NewModelRouter(spec string) (*ModelRouter, error) {
+	routes := make(map[string][]ModelRoute)
+
+	for _, aliasSpec := range strings.Split(spec, ";") {
+		aliasSpec = strings.TrimSpace(aliasSpec)
+		if aliasSpec == "" {
+			continue
+		}
+
+		alias, targets, ok := strings.Cut(aliasSpec, ":")
+		alias = strings.TrimSpace(alias)
+		if !ok || alias == "" {
+			return nil, fmt.Errorf("route %q must have the form alias:model=weight", aliasSpec)
+		}
+
+		for _, target := range strings.Split(targets, ",") {
+			model, weightText, ok := strings.Cut(strings.TrimSpace(target), "=")
+			if !ok {
+				return nil, fmt.Errorf("route target %q for %s must have the form model=weight", target, alias)
+			}
+			weight, err := strconv.Atoi(strings.TrimSpace(weightText))
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("route target %q for %s must have a positive integer weight", target, alias)
+			}
+			routes[alias] = append(routes[alias], ModelRoute{
+				Model:  strings.TrimSpace(model),
+				Weight: weight,
+			})
+		}
+	}
+
+	return &ModelRouter{
+		routes: routes,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Pick chooses a backing model for an alias according to the route weights.
+// Models without a configured route are returned unchanged.
+func (mr *ModelRouter) Pick(modelID string) string {
+	routes, ok := mr.routes[modelID]
+	if !ok {
+		return modelID
+	}
+
+	totalWeight := 0
+	for _, route := range routes {
+		totalWeight += route.Weight
+	}
+
+	mr.mutex.Lock()
+	n := mr.rng.Intn(totalWeight)
+	mr.mutex.Unlock()
+
+	for _, route := range routes {
+		if n < route.Weight {
+			log.Printf("Routing model %s to %s", modelID, route.Model)
+			return route.Model
+		}
+		n -= route.Weight
+	}
+	return routes[len(routes)-1].Model
+}
+
+// capabilityFlags returns the sorted names of the capabilities a model supports.
+// Raycast reports capabilities either as booleans or as levels such as "full",
+// so anything other than false, an empty string or "none" counts as supported.
+func capabilityFlags(capabilities map[string]interface{}) []string {
+	var flags []string
+	for name, value := range capabilities {
+		switch v := value.(type) {
+		case bool:
+			if !v {
+				continue
+			}
+		case string:
+			if v == "" || v == "none" {
+				continue
+			}
+		case nil:
+			continue
+		}
+		flags = append(flags, name)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// modelType classifies a model as "chat", "embedding" or "image", preferring the type Raycast reports
+// and otherwise looking for embedding or image generation capabilities. Models are chat models by default.
+func modelType(reported string, capabilities []string) string {
+	switch strings.ToLower(reported) {
+	case "embedding", "embeddings":
+		return "embedding"
+	case "image", "image_generation":
+		return "image"
+	case "chat", "text", "completion":
+		return "chat"
+	}
+
+	for _, capability := range capabilities {
+		switch capability {
+		case "embedding", "embeddings":
+			return "embedding"
+		case "image_generation":
+			return "image"
+		}
+	}
+	return "chat"
+}
+
+// providerOwner returns the owned_by value for models of a Raycast provider
+func providerOwner(provider string) string {
+	if owner, ok := ProviderOwners[provider]; ok {
+		return owner
+	}
+	return provider
+}
+
+// modelServedBy reports whether a cached model is offered by the provider
+func modelServedBy(modelID string, provider string, models map[string]ModelCacheEntry) bool {
+	model, ok := models[modelID]
+	if !ok {
+		return false
+	}
+	return model.Provider == provider || slices.Contains(model.Providers, provider)
+}
+
+// modelDateSuffix matches the release date ending a dated model ID, e.g. "-2024-08-06" or "-03-25"
+var modelDateSuffix = regexp.MustCompile(`-(\d{4}-)?\d{2}-\d{2}$`)
+
+// getProviderInfo gets provider info for a model.
+// The returned bool is false when the model is unknown and the configured default model was substituted.
+func getProviderInfo(config Config, modelID string, models map[string]ModelCacheEntry) (string, string, bool) {
 	if model, ok := models[modelID]; ok {
-		return model.Provider, model.Model
+		return model.Provider, model.Model, true
 	}
-	// Fallback to defaults
-	return DefaultProvider, DefaultModel
+
+	// An undated ID matches the dated releases of the model, e.g. "gemini-2.5-pro-preview"
+	// matches "gemini-2.5-pro-preview-03-25". Prefer the newest release.
+	var bestMatch string
+	for id := range models {
+		if dateSuffix := modelDateSuffix.FindString(id); dateSuffix != "" && strings.TrimSuffix(id, dateSuffix) == modelID && id > bestMatch {
+			bestMatch = id
+		}
+	}
+	if bestMatch != "" {
+		log.Printf("Resolved model %s to %s", modelID, bestMatch)
+		model := models[bestMatch]
+		return model.Provider, model.Model, true
+	}
+
+	// Fall back to the default model, as listed by Raycast when it is known
+	entry := defaultModelEntry(config)
+	if model, ok := models[entry.Model]; ok {
+		entry = model
+	}
+	log.Printf("Warning: Model %s not found, falling back to %s", modelID, entry.Model)
+	return entry.Provider, entry.Model, false
+}
+
+// defaultModelEntry describes the configured default model for when the model list doesn't include it.
+// Its provider is guessed from the model ID, see DefaultModelProviders.
+func defaultModelEntry(config Config) ModelCacheEntry {
+	model := config.DefaultModel
+	if model == "" {
+		model = DefaultModel
+	}
+
+	provider := DefaultProvider
+	for prefix, prefixProvider := range DefaultModelProviders {
+		if strings.HasPrefix(model, prefix) {
+			provider = prefixProvider
+			break
+		}
+	}
+	return ModelCacheEntry{Provider: provider, Model: model, Type: "chat", Providers: []string{provider}}
+}
+
+// modelCreated returns a stable creation timestamp for a model.
+// Raycast does not report one, so it is derived from the model ID to stay the same across calls.
+func modelCreated(modelID string) int64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(modelID))
+	return ModelCreatedEpoch + int64(hash.Sum32()%(365*24*60*60))
 }
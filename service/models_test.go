@@ -0,0 +1,88 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetProviderInfoFallsBackToConfiguredDefault(t *testing.T) {
+	models := map[string]ModelCacheEntry{
+		"gpt-4o":        {Model: "gpt-4o", Provider: "openai"},
+		"claude-sonnet": {Model: "claude-sonnet", Provider: "anthropic"},
+	}
+	config := Config{DefaultModel: "gpt-4o"}
+
+	provider, model, found := getProviderInfo(config, "no-such-model", models)
+	if found || provider != "openai" || model != "gpt-4o" {
+		t.Fatalf("got %s/%s (found %v), want the configured default openai/gpt-4o", provider, model, found)
+	}
+
+	// A default missing from the list keeps its ID, with a provider guessed from it
+	config.DefaultModel = "gemini-2.5-pro"
+	if provider, model, _ := getProviderInfo(config, "no-such-model", models); provider != "google" || model != "gemini-2.5-pro" {
+		t.Fatalf("got %s/%s, want google/gemini-2.5-pro", provider, model)
+	}
+}
+
+func TestGetProviderInfoDateSuffix(t *testing.T) {
+	models := map[string]ModelCacheEntry{
+		"gemini-2.5-pro-preview-03-25": {Model: "gemini-2.5-pro-preview-03-25", Provider: "google"},
+		"gemini-2.5-pro-preview-05-06": {Model: "gemini-2.5-pro-preview-05-06", Provider: "google"},
+		"gpt-4o-2024-08-06":            {Model: "gpt-4o-2024-08-06", Provider: "openai"},
+		"gpt-4o-mini":                  {Model: "gpt-4o-mini", Provider: "openai"},
+	}
+	tests := []struct {
+		modelID string
+		want    string
+		found   bool
+	}{
+		{"gemini-2.5-pro-preview", "gemini-2.5-pro-preview-05-06", true},
+		{"gpt-4o", "gpt-4o-2024-08-06", true},
+		{"gpt-4o-mini", "gpt-4o-mini", true},
+		// Only a trailing date is ignored, so neither prefixes nor extensions of a listed ID match
+		{"gemini-2.5-pro", DefaultModel, false},
+		{"gpt-4", DefaultModel, false},
+		{"gpt-4o-mini-2024-07-18", DefaultModel, false},
+		{"gpt-4o-2024", DefaultModel, false},
+	}
+	for _, tt := range tests {
+		if _, model, found := getProviderInfo(Config{}, tt.modelID, models); found != tt.found || model != tt.want {
+			t.Errorf("%s: got %s (found %v), want %s (found %v)", tt.modelID, model, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestGetModelsFetchFailureUsesConfiguredDefault(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig(upstream.URL)
+	config.DefaultModel = "gpt-4o-mini"
+	models, err := config.ModelCache.GetModels(config)
+	if err == nil {
+		t.Fatal("expected the fetch error to be returned")
+	}
+	entry, ok := models["gpt-4o-mini"]
+	if !ok || entry.Provider != "openai" || len(models) != 1 {
+		t.Fatalf("expected only the configured default model, got %+v", models)
+	}
+}
+
+func TestDefaultModelUsedWhenRequestOmitsModel(t *testing.T) {
+	var upstreamModel, upstreamProvider string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		upstreamModel, upstreamProvider = req.Model, req.Provider
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.DefaultModel = "claude-sonnet"
+	router := Router(&config)
+
+	doRequest(router, http.MethodPost, "/v1/chat/completions", `{"messages":[{"role":"user","content":"Hi"}]}`)
+	if upstreamModel != "claude-sonnet" || upstreamProvider != "anthropic" {
+		t.Fatalf("upstream got %s/%s, want anthropic/claude-sonnet", upstreamProvider, upstreamModel)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 18:20:13
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 18:20:13
+ * @FilePath: /raycast2api/service/moderation.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ModerationTimeout caps how long a prompt waits for the moderation service
+const ModerationTimeout = 10 * time.Second
+
+// ErrModerationUnavailable is returned when the moderation service fails and the moderator fails closed
+var ErrModerationUnavailable = errors.New("moderation service unavailable")
+
+// Moderator checks prompts against an external moderation service before they reach Raycast
+type Moderator struct {
+	url      string
+	failOpen bool // Let prompts through when the moderation service fails
+	client   *http.Client
+}
+
+// NewModerator creates a moderator posting prompts to url
+func NewModerator(url string, failOpen bool) *Moderator {
+	return &Moderator{
+		url:      url,
+		failOpen: failOpen,
+		client:   &http.Client{Timeout: ModerationTimeout},
+	}
+}
+
+// Check reports whether the prompt was flagged. When the moderation service fails, the prompt
+// is allowed in fail-open mode and ErrModerationUnavailable is returned otherwise.
+// A nil moderator allows everything.
+func (m *Moderator) Check(prompt string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+
+	flagged, err := m.query(prompt)
+	if err != nil {
+		log.Printf("Moderation check failed: %v", err)
+		if m.failOpen {
+			return false, nil
+		}
+		return false, ErrModerationUnavailable
+	}
+	return flagged, nil
+}
+
+// query posts the prompt to the moderation service. Both {"flagged": true} and
+// OpenAI-style {"results": [{"flagged": true}]} responses are understood.
+func (m *Moderator) query(prompt string) (bool, error) {
+	requestBody, err := json.Marshal(map[string]string{"input": prompt})
+	if err != nil {
+		return false, fmt.Errorf("error encoding request: %w", err)
+	}
+
+	resp, err := m.client.Post(m.url, "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return false, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("moderation service error: %d %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var result struct {
+		Flagged bool `json:"flagged"`
+		Results []struct {
+			Flagged bool `json:"flagged"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	flagged := result.Flagged
+	for _, r := range result.Results {
+		flagged = flagged || r.Flagged
+	}
+	return flagged, nil
+}
+
+// moderationInput concatenates the instructions and messages of an upstream request for moderation
+func moderationInput(raycastRequest RaycastChatRequest) string {
+	parts := []string{}
+	if raycastRequest.SystemInstruction != "" {
+		parts = append(parts, raycastRequest.SystemInstruction)
+	}
+	if raycastRequest.AdditionalSystemInstructions != "" {
+		parts = append(parts, raycastRequest.AdditionalSystemInstructions)
+	}
+	for _, msg := range raycastRequest.Messages {
+		parts = append(parts, msg.Content.Text)
+	}
+	return strings.Join(parts, "\n\n")
+}
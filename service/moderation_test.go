@@ -0,0 +1,56 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestModerationCoversEverythingSentUpstream(t *testing.T) {
+	moderation := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Input string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]bool{"flagged": strings.Contains(request.Input, "forbidden")})
+	}))
+	defer moderation.Close()
+
+	var calls atomic.Int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		calls.Add(1)
+		writeSSE(w, RaycastSSEData{Text: "OK"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.Moderator = NewModerator(moderation.URL, false)
+	router := Router(&config)
+
+	rejected := map[string]string{
+		"message":                 `{"model":"gpt-4o","messages":[{"role":"user","content":"forbidden"}]}`,
+		"system message":          `{"model":"gpt-4o","messages":[{"role":"system","content":"forbidden"},{"role":"user","content":"Hi"}]}`,
+		"additional instructions": `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"additional_system_instructions":"forbidden"}`,
+		"response format":         `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"answer","description":"forbidden","schema":{"type":"object"}}}}`,
+	}
+	for name, request := range rejected {
+		recorder := doRequest(router, http.MethodPost, "/v1/chat/completions", request)
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "content_filter") {
+			t.Errorf("%s: expected a content_filter rejection, got %d %s", name, recorder.Code, recorder.Body)
+		}
+	}
+
+	recorder := doRequest(router, http.MethodPost, "/v1/messages", `{"model":"gpt-4o","max_tokens":10,"system":"forbidden","messages":[{"role":"user","content":"Hi"}]}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("anthropic system prompt: expected a rejection, got %d %s", recorder.Code, recorder.Body)
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("flagged prompts reached the upstream %d times", calls.Load())
+	}
+
+	recorder = doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if recorder.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("clean prompt was not sent upstream: %d %s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 18:47:20
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 18:47:20
+ * @FilePath: /raycast2api/service/realtime.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// RealtimeQueueSize is how many chat requests a WebSocket client can queue while a completion streams
+const RealtimeQueueSize = 16
+
+// realtimeHeaders are copied from the WebSocket handshake onto each chat request.
+// Credential headers are already removed from the handshake, the API key is passed on separately.
+var realtimeHeaders = []string{"X-Forwarded-For", "OpenAI-Organization", "OpenAI-Project", "X-Request-Timeout", "X-Provider"}
+
+// handleRealtime upgrades to a WebSocket that accepts chat completion requests as text messages
+// and streams the completion chunks back as messages, ending each completion with "[DONE]".
+// Requests are served by the regular chat completions route, so they get the same auth, limits and logging.
+func handleRealtime(c *gin.Context, router http.Handler, routePrefix string, allowedOrigins map[string]bool) {
+	server := websocket.Server{
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			return checkRealtimeOrigin(req, allowedOrigins)
+		},
+		Handler: func(ws *websocket.Conn) {
+			serveRealtime(c.Request, c.GetString(apiKeyKey), ws, router, routePrefix+"/v1/chat/completions")
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// checkRealtimeOrigin rejects WebSocket handshakes from other sites' pages, which browsers make with
+// the user's cookies and without the same-origin policy. Requests without an Origin header come from
+// non-browser clients and are allowed, as are same-origin requests and the origins in allowed,
+// where "*" allows any origin.
+func checkRealtimeOrigin(req *http.Request, allowed map[string]bool) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" || allowed["*"] || allowed[normalizeOrigin(origin)] {
+		return nil
+	}
+	if originURL, err := url.Parse(origin); err == nil && strings.EqualFold(originURL.Host, req.Host) {
+		return nil
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// serveRealtime serves chat requests from a WebSocket one at a time until the client closes it.
+// Closing the socket mid-stream cancels the in-flight completion and its upstream request.
+// Requests arriving while the queue is full are answered with an error.
+func serveRealtime(handshake *http.Request, apiKey string, ws *websocket.Conn, router http.Handler, chatPath string) {
+	requests := make(chan []byte, RealtimeQueueSize)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var message []byte
+			if err := websocket.Message.Receive(ws, &message); err != nil {
+				return
+			}
+			select {
+			case requests <- message:
+			default:
+				log.Println("Realtime request queue full, rejecting request")
+				sendRealtimeError(ws, "rate_limit_exceeded", fmt.Sprintf("Too many queued requests, at most %d can wait", RealtimeQueueSize))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case message := <-requests:
+			ctx, cancel := context.WithCancel(handshake.Context())
+			go func() {
+				select {
+				case <-closed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			serveRealtimeRequest(ctx, handshake, apiKey, ws, router, chatPath, message)
+			cancel()
+		case <-closed:
+			return
+		}
+	}
+}
+
+// serveRealtimeRequest runs one chat request through the router as a streaming request
+func serveRealtimeRequest(ctx context.Context, handshake *http.Request, apiKey string, ws *websocket.Conn, router http.Handler, chatPath string, message []byte) {
+	var body map[string]interface{}
+	if err := json.Unmarshal(message, &body); err != nil {
+		sendRealtimeError(ws, "invalid_request_error", "Invalid request message: "+err.Error())
+		return
+	}
+	body["stream"] = true
+	requestBody, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, chatPath, bytes.NewReader(requestBody))
+	if err != nil {
+		sendRealtimeError(ws, "invalid_request_error", err.Error())
+		return
+	}
+	req.RemoteAddr = handshake.RemoteAddr
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	for _, name := range realtimeHeaders {
+		if value := handshake.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	writer := &realtimeWriter{ws: ws, header: make(http.Header)}
+	router.ServeHTTP(writer, req)
+	writer.finish()
+}
+
+// sendRealtimeError sends an error in the same envelope as the HTTP API.
+// Sends are safe alongside a streaming completion, the connection writes whole frames under a lock.
+func sendRealtimeError(ws *websocket.Conn, errorType string, message string) {
+	errorResponse := ErrorResponse{}
+	errorResponse.Error.Message = message
+	errorResponse.Error.Type = errorType
+	websocket.JSON.Send(ws, errorResponse)
+}
+
+// realtimeWriter is an http.ResponseWriter that forwards each SSE data payload as a WebSocket message.
+// Responses that are not event streams, such as errors, are sent as a single message.
+type realtimeWriter struct {
+	ws      *websocket.Conn
+	header  http.Header
+	status  int
+	pending bytes.Buffer
+}
+
+func (w *realtimeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *realtimeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *realtimeWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.pending.Write(p)
+	if !w.streaming() {
+		return len(p), nil
+	}
+
+	// Forward every complete SSE event, keepalive comments are dropped
+	for {
+		event, rest, found := strings.Cut(w.pending.String(), "\n\n")
+		if !found {
+			break
+		}
+		w.pending.Reset()
+		w.pending.WriteString(rest)
+
+		for _, line := range strings.Split(event, "\n") {
+			if data, ok := strings.CutPrefix(line, "data:"); ok {
+				if err := websocket.Message.Send(w.ws, strings.TrimSpace(data)); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op, every event is sent as soon as it is complete
+func (w *realtimeWriter) Flush() {}
+
+// finish sends a buffered non-streaming response
+func (w *realtimeWriter) finish() {
+	if !w.streaming() && w.pending.Len() > 0 {
+		websocket.Message.Send(w.ws, w.pending.String())
+	}
+}
+
+// streaming reports whether the response is an event stream
+func (w *realtimeWriter) streaming() bool {
+	return strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialRealtime opens a WebSocket to the realtime endpoint of server
+func dialRealtime(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/realtime"
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// receiveRealtime reads the next message, failing the test if none arrives in time
+func receiveRealtime(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message string
+	if err := websocket.Message.Receive(ws, &message); err != nil {
+		t.Fatalf("receiving message: %v", err)
+	}
+	return message
+}
+
+func TestRealtimeStreamsCompletion(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hel"}, RaycastSSEData{Text: "lo"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	ws := dialRealtime(t, server)
+	for i := 0; i < 2; i++ {
+		websocket.Message.Send(ws, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+
+		var text strings.Builder
+		for {
+			message := receiveRealtime(t, ws)
+			if message == "[DONE]" {
+				break
+			}
+			var chunk OpenAIChatChunk
+			if err := json.Unmarshal([]byte(message), &chunk); err != nil {
+				t.Fatalf("invalid chunk %q: %v", message, err)
+			}
+			if len(chunk.Choices) > 0 {
+				text.WriteString(chunk.Choices[0].Delta.Content)
+			}
+		}
+		if text.String() != "Hello" {
+			t.Fatalf("completion %d: expected Hello, got %q", i+1, text.String())
+		}
+	}
+}
+
+func TestRealtimeRejectsInvalidMessage(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {})
+	config := newTestConfig(upstream.URL)
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	ws := dialRealtime(t, server)
+	websocket.Message.Send(ws, `not json`)
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal([]byte(receiveRealtime(t, ws)), &errorResponse); err != nil || errorResponse.Error.Type != "invalid_request_error" {
+		t.Fatalf("expected an invalid_request_error, got %+v (%v)", errorResponse, err)
+	}
+}
+
+func TestRealtimeCloseCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hel"})
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	})
+	config := newTestConfig(upstream.URL)
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	ws := dialRealtime(t, server)
+	websocket.Message.Send(ws, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	receiveRealtime(t, ws)
+	ws.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the socket did not cancel the upstream request")
+	}
+}
+
+func TestRealtimeQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"})
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	defer close(release)
+	config := newTestConfig(upstream.URL)
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	ws := dialRealtime(t, server)
+	request := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`
+	websocket.Message.Send(ws, request)
+	receiveRealtime(t, ws) // The first request is streaming and holds up the queue
+
+	for i := 0; i <= RealtimeQueueSize; i++ {
+		websocket.Message.Send(ws, request)
+	}
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal([]byte(receiveRealtime(t, ws)), &errorResponse); err != nil || errorResponse.Error.Type != "rate_limit_exceeded" {
+		t.Fatalf("expected a rate_limit_exceeded error for the overflowing request, got %+v (%v)", errorResponse, err)
+	}
+}
+
+func TestStreamingClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hel"})
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	})
+	config := newTestConfig(upstream.URL)
+	server := httptest.NewServer(Router(&config))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("streaming request failed: %v", err)
+	}
+	resp.Body.Read(make([]byte, 64))
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client disconnect did not cancel the upstream request")
+	}
+}
+
+func TestRealtimeOriginCheck(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+
+	tests := []struct {
+		name    string
+		allowed string
+		origin  func(server *httptest.Server) string
+		ok      bool
+	}{
+		{"same origin", "", func(server *httptest.Server) string { return server.URL }, true},
+		{"cross origin", "", func(*httptest.Server) string { return "https://evil.example" }, false},
+		{"allowed origin", "https://app.example/", func(*httptest.Server) string { return "https://App.example" }, true},
+		{"other origin", "https://app.example", func(*httptest.Server) string { return "https://evil.example" }, false},
+		{"any origin", "*", func(*httptest.Server) string { return "https://evil.example" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig(upstream.URL)
+			config.RealtimeOrigins = parseAllowedOrigins(tt.allowed)
+			server := httptest.NewServer(Router(&config))
+			defer server.Close()
+
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/realtime"
+			ws, err := websocket.Dial(url, "", tt.origin(server))
+			if err == nil {
+				ws.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected handshake allowed %v, got error %v", tt.ok, err)
+			}
+		})
+	}
+}
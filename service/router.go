@@ -15,6 +15,7 @@ package service
 import (
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -26,7 +27,7 @@ func setupMiddlewares(router *gin.Engine, config Config) {
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(ClientHeaders, ", "))
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
@@ -36,9 +37,64 @@ func setupMiddlewares(router *gin.Engine, config Config) {
 		c.Next()
 	})
 
-	// API key validation middleware
+	// Tracing middleware, a span per request continuing the caller's trace
 	router.Use(func(c *gin.Context) {
-		if !validateAPIKey(c, config) {
+		if config.Tracer == nil {
+			c.Next()
+			return
+		}
+		ctx, span := config.Tracer.StartRequestSpan(c.Request)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		endSpan(span, c.Writer.Status())
+	})
+}
+
+// setupIPMiddlewares configures the IP filter and per-IP rate limit middlewares for the routes registered after it
+func setupIPMiddlewares(routes *gin.RouterGroup, config Config) {
+	// IP allowlist, denylist and rate limit middleware
+	routes.Use(func(c *gin.Context) {
+		clientIP := c.ClientIP()
+		if !config.IPFilter.Allowed(clientIP) {
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: "Access denied for this IP address",
+					Type:    "permission_error",
+				},
+			})
+			c.Abort()
+			return
+		}
+		if !config.IPRateLimiter.Allow(clientIP) {
+			c.JSON(http.StatusTooManyRequests, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: "Rate limit exceeded for this IP address, please retry later",
+					Type:    "rate_limit_exceeded",
+				},
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	})
+}
+
+// setupAuthMiddlewares configures the client authentication middlewares for the routes registered after it
+func setupAuthMiddlewares(routes *gin.RouterGroup, config Config) {
+	// API key validation middleware
+	routes.Use(func(c *gin.Context) {
+		authStart := time.Now()
+		valid := validateAPIKey(c, config)
+		c.Set(timingAuth, time.Since(authStart))
+		if !valid {
 			c.JSON(http.StatusUnauthorized, ErrorResponse{
 				Error: struct {
 					Message string `json:"message"`
@@ -55,8 +111,17 @@ func setupMiddlewares(router *gin.Engine, config Config) {
 		c.Next()
 	})
 
+	// Credential stripping middleware, the API key stays available to the audit log and WebSocket requests
+	routes.Use(func(c *gin.Context) {
+		c.Set(apiKeyKey, requestAPIKey(c))
+		for _, name := range CredentialHeaders {
+			c.Request.Header.Del(name)
+		}
+		c.Next()
+	})
+
 	// Log request middleware
-	router.Use(func(c *gin.Context) {
+	routes.Use(func(c *gin.Context) {
 		timestamp := time.Now().Format(time.RFC3339)
 		log.Printf("[%s] %s %s", timestamp, c.Request.Method, c.Request.URL.Path)
 		c.Next()
@@ -66,21 +131,95 @@ func setupMiddlewares(router *gin.Engine, config Config) {
 // setupRoutes configures all routes for the application
 func Router(config *Config) *gin.Engine {
 	router := gin.Default()
+	// Only honor X-Forwarded-For when running behind a trusted reverse proxy
+	if !config.TrustProxy {
+		router.SetTrustedProxies(nil)
+	}
+	config.setDefaults()
 	setupMiddlewares(router, *config) // Dereference when passing to setupMiddlewares
-	router.POST("/v1/chat/completions", func(c *gin.Context) {
+
+	// Mount every route under the optional prefix, e.g. /raycast/v1/chat/completions
+	routes := router.Group(config.RoutePrefix)
+
+	// Probes are registered before the IP filter, rate limit and client authentication,
+	// load balancers call them from their own addresses without an API key
+	routes.GET("/health", func(c *gin.Context) {
+		handleHealth(c, *config) // Dereference when passing to handlers
+	})
+
+	routes.GET("/ready", func(c *gin.Context) {
+		handleReady(c, *config) // Dereference when passing to handlers
+	})
+
+	setupIPMiddlewares(routes, *config)
+
+	// Admin endpoints require the admin API key rather than a client key
+	if config.EnableAdmin {
+		admin := routes.Group("/admin", func(c *gin.Context) {
+			if !validateAdminKey(c, *config) {
+				c.JSON(http.StatusUnauthorized, ErrorResponse{
+					Error: struct {
+						Message string `json:"message"`
+						Type    string `json:"type"`
+						Details string `json:"details,omitempty"`
+					}{
+						Message: "Invalid admin API key",
+						Type:    "authentication_error",
+					},
+				})
+				c.Abort()
+				return
+			}
+			c.Next()
+		})
+
+		admin.GET("/cache", func(c *gin.Context) {
+			handleAdminCache(c, *config) // Dereference when passing to handlers
+		})
+
+		admin.POST("/drain", func(c *gin.Context) {
+			handleAdminDrain(c, *config) // Dereference when passing to handlers
+		})
+	}
+
+	setupAuthMiddlewares(routes, *config)
+
+	routes.POST("/v1/chat/completions", func(c *gin.Context) {
 		handleChatCompletions(c, *config) // Dereference when passing to handlers
 	})
 
-	router.GET("/v1/models", func(c *gin.Context) {
+	// Azure OpenAI path shape, the deployment name is used as the model
+	routes.POST("/openai/deployments/:deployment/chat/completions", func(c *gin.Context) {
+		handleChatCompletions(c, *config) // Dereference when passing to handlers
+	})
+
+	routes.POST("/v1/messages", func(c *gin.Context) {
+		handleMessages(c, *config) // Dereference when passing to handlers
+	})
+
+	// WebSocket alternative to streaming chat completions over SSE
+	routes.GET("/v1/realtime", func(c *gin.Context) {
+		handleRealtime(c, router, config.RoutePrefix, config.RealtimeOrigins)
+	})
+
+	routes.GET("/v1/models", func(c *gin.Context) {
 		handleModels(c, *config) // Dereference when passing to handlers
 	})
 
-	router.GET("/v1/refresh-models", func(c *gin.Context) {
+	routes.GET("/v1/providers", func(c *gin.Context) {
+		handleProviders(c, *config) // Dereference when passing to handlers
+	})
+
+	routes.GET("/v1/refresh-models", func(c *gin.Context) {
 		handleRefreshModels(c, *config) // Dereference when passing to handlers
 	})
 
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	routes.GET("/v1/usage", func(c *gin.Context) {
+		handleUsage(c, *config)
+	})
+
+	routes.GET("/version", func(c *gin.Context) {
+		handleVersion(c)
 	})
 
 	return router
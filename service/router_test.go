@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProbesSkipAuthentication(t *testing.T) {
+	config := newTestConfig("http://127.0.0.1:1")
+	config.APIKey = "client-key"
+	router := Router(&config)
+
+	for _, path := range []string{"/health", "/ready"} {
+		if recorder := doRequest(router, http.MethodGet, path, ""); recorder.Code != http.StatusOK {
+			t.Errorf("%s without an API key: got %d, want 200", path, recorder.Code)
+		}
+	}
+	if recorder := doRequest(router, http.MethodGet, "/v1/providers", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("/v1/providers without an API key: got %d, want 401", recorder.Code)
+	}
+}
+
+func TestProbesSkipIPFilter(t *testing.T) {
+	config := newTestConfig("http://127.0.0.1:1")
+	filter, err := NewIPFilter("", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.IPFilter = filter
+	config.IPRateLimiter = NewIPRateLimiter(1)
+	router := Router(&config)
+
+	// httptest requests come from 192.0.2.1
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/health", "/ready"} {
+			if recorder := doRequest(router, http.MethodGet, path, ""); recorder.Code != http.StatusOK {
+				t.Errorf("%s from a denied IP: got %d, want 200", path, recorder.Code)
+			}
+		}
+	}
+	if recorder := doRequest(router, http.MethodGet, "/v1/providers", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("/v1/providers from a denied IP: got %d, want 403", recorder.Code)
+	}
+
+	// Probes don't count towards the rate limit
+	config.IPFilter = nil
+	router = Router(&config)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		doRequest(router, http.MethodGet, "/health", "")
+		if recorder := doRequest(router, http.MethodGet, "/v1/providers", ""); recorder.Code != want {
+			t.Errorf("/v1/providers request %d: got %d, want %d", i+1, recorder.Code, want)
+		}
+	}
+}
+
+func TestAdminRequiresAdminKey(t *testing.T) {
+	config := newTestConfig("http://127.0.0.1:1")
+	config.APIKey = "client-key"
+	config.AdminAPIKey = "admin-key"
+	config.EnableAdmin = true
+	router := Router(&config)
+
+	tests := []struct {
+		name    string
+		headers []string
+		want    int
+	}{
+		{"no key", nil, http.StatusUnauthorized},
+		{"client key", []string{"Authorization", "Bearer client-key"}, http.StatusUnauthorized},
+		{"admin key", []string{"Authorization", "Bearer admin-key"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if recorder := doRequest(router, http.MethodPost, "/admin/drain", "", tt.headers...); recorder.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, recorder.Code, tt.want)
+		}
+	}
+
+	// The drained instance fails its readiness probe
+	if recorder := doRequest(router, http.MethodGet, "/ready", ""); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready after draining: got %d, want 503", recorder.Code)
+	}
+}
+
+func TestAdminDisabledByDefault(t *testing.T) {
+	config := newTestConfig("http://127.0.0.1:1")
+	router := Router(&config)
+
+	if recorder := doRequest(router, http.MethodGet, "/admin/cache", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("/admin/cache with admin disabled: got %d, want 404", recorder.Code)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 17:31:05
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 17:31:05
+ * @FilePath: /raycast2api/service/schema.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// schemaInstruction returns the system instruction asking the model to follow a json_schema response format,
+// or an empty string for other formats
+func schemaInstruction(format *ResponseFormat) string {
+	if format == nil || format.Type != "json_schema" || format.JSONSchema == nil {
+		return ""
+	}
+
+	schema, err := json.Marshal(format.JSONSchema.Schema)
+	if err != nil {
+		return ""
+	}
+
+	instruction := "Respond only with a JSON value that matches the following JSON schema, without markdown code fences or any other text."
+	if format.JSONSchema.Description != "" {
+		instruction += "\n" + format.JSONSchema.Description
+	}
+	return instruction + "\n" + string(schema)
+}
+
+// validateSchemaResponse checks that text is JSON matching the json_schema response format.
+// It returns the text with any markdown code fence removed.
+func validateSchemaResponse(text string, format *ResponseFormat) (string, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSpace(strings.TrimSuffix(text, "```"))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return text, fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	return text, validateJSONSchema(value, format.JSONSchema.Schema, "$")
+}
+
+// validateJSONSchema validates a decoded JSON value against the commonly used subset of JSON Schema:
+// type, enum, properties, required, additionalProperties and items
+func validateJSONSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if schemaType, ok := schema["type"]; ok && !matchesSchemaType(value, schemaType) {
+		return fmt.Errorf("%s: expected type %v", path, schemaType)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of %v", path, enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		for key, propertyValue := range v {
+			propertySchema, known := properties[key].(map[string]interface{})
+			if !known {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s: unexpected property %q", path, key)
+				}
+				continue
+			}
+			if err := validateJSONSchema(propertyValue, propertySchema, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchesSchemaType reports whether a decoded JSON value has the schema type, which may be a name or a list of names
+func matchesSchemaType(value interface{}, schemaType interface{}) bool {
+	switch t := schemaType.(type) {
+	case string:
+		switch t {
+		case "object":
+			_, ok := value.(map[string]interface{})
+			return ok
+		case "array":
+			_, ok := value.([]interface{})
+			return ok
+		case "string":
+			_, ok := value.(string)
+			return ok
+		case "number":
+			_, ok := value.(float64)
+			return ok
+		case "integer":
+			number, ok := value.(float64)
+			return ok && number == float64(int64(number))
+		case "boolean":
+			_, ok := value.(bool)
+			return ok
+		case "null":
+			return value == nil
+		default:
+			return true // Unknown types are not enforced
+		}
+	case []interface{}:
+		for _, name := range t {
+			if matchesSchemaType(value, name) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// retrySchemaResponse asks the model once more for output matching the schema, showing it the validation error.
+// It returns the new text and finish reason, and the validation error if the retry still doesn't match.
+func retrySchemaResponse(ctx context.Context, config Config, raycastRequest RaycastChatRequest, format *ResponseFormat, fullText string, validationErr error) (string, string, error) {
+	raycastRequest.Messages = append(append([]RaycastMessage{}, raycastRequest.Messages...),
+		RaycastMessage{
+			Author: "assistant",
+			Content: struct {
+				Text string `json:"text"`
+			}{Text: fullText},
+		},
+		RaycastMessage{
+			Author: "user",
+			Content: struct {
+				Text string `json:"text"`
+			}{Text: fmt.Sprintf("That response does not match the required JSON schema (%v). Respond again with only JSON that matches the schema.", validationErr)},
+		},
+	)
+
+	resp, err := sendRaycastRequest(ctx, config, raycastRequest, nil)
+	if err != nil {
+		return fullText, "", fmt.Errorf("error sending schema retry request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fullText, "", fmt.Errorf("schema retry request failed with status %d", resp.StatusCode)
+	}
+
+	text, _, reason, _, _, err := parseSSEResponse(resp.Body)
+	if err != nil {
+		return fullText, "", fmt.Errorf("error reading schema retry response: %w", err)
+	}
+	log.Printf("Schema retry returned %d characters, finish reason: %s", len(text), reason)
+
+	text, err = validateSchemaResponse(text, format)
+	return text, reason, err
+}
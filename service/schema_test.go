@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testSchema = `{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"}},"required":["name"],"additionalProperties":false}`
+
+func testSchemaFormat(t *testing.T) *ResponseFormat {
+	t.Helper()
+	format := &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "person"}}
+	if err := json.Unmarshal([]byte(testSchema), &format.JSONSchema.Schema); err != nil {
+		t.Fatal(err)
+	}
+	return format
+}
+
+func TestValidateSchemaResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{"valid", `{"name":"Ada","age":36}`, ""},
+		{"optional property omitted", `{"name":"Ada"}`, ""},
+		{"code fence", "```json\n{\"name\":\"Ada\"}\n```", ""},
+		{"missing required", `{"age":36}`, `missing required property "name"`},
+		{"wrong type", `{"name":"Ada","age":36.5}`, "$.age: expected type integer"},
+		{"unexpected property", `{"name":"Ada","email":"ada@example.com"}`, `unexpected property "email"`},
+		{"not an object", `["Ada"]`, "$: expected type object"},
+		{"invalid JSON", `{"name":`, "not valid JSON"},
+	}
+	format := testSchemaFormat(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := validateSchemaResponse(tt.text, format)
+			if tt.wantErr == "" {
+				if err != nil || !json.Valid([]byte(text)) {
+					t.Fatalf("expected valid JSON without error, got %q, %v", text, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// schemaRequest is a chat request asking for the test schema
+var schemaRequest = `{"model":"gpt-4o","messages":[{"role":"user","content":"Who?"}],"response_format":{"type":"json_schema","json_schema":{"name":"person","schema":` + testSchema + `}}}`
+
+func TestSchemaResponseRetriedOnce(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		if !strings.Contains(req.AdditionalSystemInstructions, `"required":["name"]`) {
+			t.Errorf("schema missing from the system instructions: %q", req.AdditionalSystemInstructions)
+		}
+		if calls.Add(1) == 1 {
+			writeSSE(w, RaycastSSEData{Text: `{"age":36}`}, RaycastSSEData{FinishReason: "stop"})
+			return
+		}
+		writeSSE(w, RaycastSSEData{Text: `{"name":"Ada","age":36}`}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+
+	w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", schemaRequest)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := decodeCompletion(t, w.Body).Choices[0].Message.Content; got != `{"name":"Ada","age":36}` {
+		t.Fatalf("expected the retried response, got %q", got)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", calls.Load())
+	}
+}
+
+func TestSchemaResponseFailsAfterRetry(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		calls.Add(1)
+		writeSSE(w, RaycastSSEData{Text: `{"age":36}`}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+
+	w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", schemaRequest)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d: %s", w.Code, w.Body.String())
+	}
+	var errorResponse ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errorResponse)
+	if !strings.Contains(errorResponse.Error.Details, `missing required property "name"`) {
+		t.Fatalf("validation error missing from the error details: %s", w.Body.String())
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected exactly one retry, got %d upstream requests", calls.Load())
+	}
+}
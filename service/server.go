@@ -0,0 +1,109 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 11:48:02
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 11:48:02
+ * @FilePath: /raycast2api/service/server.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ShutdownTimeout is how long in-flight requests get to finish during shutdown
+const ShutdownTimeout = 30 * time.Second
+
+// Run serves the proxy until ctx is cancelled, then shuts down gracefully.
+// It can be used to embed the proxy in another Go program.
+// HTTPS is served when a TLS certificate is configured, requiring client certificates when a client CA is set.
+// A Config built by hand needs only a bearer token, unset dependencies and settings get InitConfig's defaults.
+func Run(ctx context.Context, config *Config) error {
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	config.setDefaults()
+	server := &http.Server{
+		Addr:    listenAddr(config.Host, config.Port),
+		Handler: Router(config),
+	}
+
+	if config.TLSCertFile != "" {
+		tlsConfig, err := newTLSConfig(config.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if config.TLSCertFile != "" {
+			serverErr <- server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, waiting for in-flight requests to finish...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error shutting down server: %w", err)
+	}
+	config.Tracer.Shutdown()
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listenAddr combines the bind host and port into a listen address.
+// An empty host listens on all interfaces, IPv6 hosts are bracketed.
+func listenAddr(host string, port string) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// newTLSConfig builds the server TLS config. With a client CA file, connections
+// must present a client certificate signed by one of its CAs.
+func newTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caData, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+	}
+
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
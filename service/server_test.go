@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Config built by hand with only a token and upstream URLs must serve without panicking
+func TestRouterHandBuiltConfig(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hello"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := &Config{
+		RaycastBearerToken: "test-token",
+		APIURLs:            []string{upstream.URL},
+		ModelsURLs:         []string{upstream.URL + "/models"},
+	}
+
+	w := doRequest(Router(config), http.MethodPost, "/v1/chat/completions",
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := decodeCompletion(t, w.Body).Choices[0].Message.Content; got != "Hello" {
+		t.Fatalf("expected Hello, got %q", got)
+	}
+	if config.DefaultModel != DefaultModel || config.Source != DefaultSource || config.ModelCacheTTL != ModelCacheTTL {
+		t.Fatalf("defaults not applied: %+v", config)
+	}
+}
+
+func TestRunRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"no token", Config{}, "bearer token"},
+		{"cert without key", Config{RaycastBearerToken: "t", TLSCertFile: "cert.pem"}, "TLSKeyFile"},
+		{"admin without key", Config{RaycastBearerToken: "t", EnableAdmin: true}, "AdminAPIKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Run(context.Background(), &tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRunShutsDownOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	config := &Config{RaycastBearerToken: "test-token", Host: "127.0.0.1", Port: "0"}
+
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, config) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after cancellation", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is an event delivered by readSSEEvents
+type sseEvent struct {
+	event string
+	data  string
+}
+
+func readAllSSEEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	err := readSSEEvents(strings.NewReader(body), func(event string, data string) bool {
+		events = append(events, sseEvent{event, data})
+		return true
+	})
+	if err != nil {
+		t.Fatalf("readSSEEvents: %v", err)
+	}
+	return events
+}
+
+func TestReadSSEEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []sseEvent
+	}{
+		{"single", "data: {\"text\":\"a\"}\n\n", []sseEvent{{"", `{"text":"a"}`}}},
+		{"no space after colon", "data:{\"text\":\"a\"}\n\n", []sseEvent{{"", `{"text":"a"}`}}},
+		{"crlf", "data: a\r\n\r\ndata: b\r\n\r\n", []sseEvent{{"", "a"}, {"", "b"}}},
+		{"multi-line data", "data: {\"text\":\ndata: \"a\"}\n\n", []sseEvent{{"", "{\"text\":\n\"a\"}"}}},
+		{"comments and unknown fields", ": keepalive\nid: 1\ndata: a\n\n", []sseEvent{{"", "a"}}},
+		{"event type", "event: error\ndata: boom\n\ndata: next\n\n", []sseEvent{{"error", "boom"}, {"", "next"}}},
+		{"event without data", "event: ping\n\ndata: a\n\n", []sseEvent{{"", "a"}}},
+		{"unterminated last event", "data: a\n\ndata: b", []sseEvent{{"", "a"}, {"", "b"}}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readAllSSEEvents(t, tt.body); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSSEEventsStopsEarly(t *testing.T) {
+	calls := 0
+	readSSEEvents(strings.NewReader("data: a\n\ndata: b\n\n"), func(event string, data string) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("handler called %d times after asking to stop", calls)
+	}
+}
+
+func TestReadSSEEventsLineTooLong(t *testing.T) {
+	body := "data: " + strings.Repeat("a", MaxSSELineBytes+1) + "\n\n"
+	err := readSSEEvents(strings.NewReader(body), func(event string, data string) bool { return true })
+	if err != bufio.ErrTooLong {
+		t.Fatalf("expected bufio.ErrTooLong, got %v", err)
+	}
+}
+
+func TestParseSSEResponse(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"reasoning":"Let me think"}`, "",
+		`data: {"text":"Hello, "}`, "",
+		`data: {"text":"world","citations":[{"url":"https://example.com"}]}`, "",
+		`data: {"finish_reason":"max_tokens"}`, "",
+	}, "\n")
+
+	text, reasoning, finishReason, citations, _, err := parseSSEResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("parseSSEResponse: %v", err)
+	}
+	if text != "Hello, world" || reasoning != "Let me think" || finishReason != "max_tokens" {
+		t.Errorf("got text %q, reasoning %q, finish reason %q", text, reasoning, finishReason)
+	}
+	if len(citations) != 1 || citations[0].URL != "https://example.com" {
+		t.Errorf("got citations %+v", citations)
+	}
+}
+
+func TestParseSSEResponseErrorEvent(t *testing.T) {
+	body := "data: {\"text\":\"Partial\"}\n\nevent: error\ndata: {\"error\":{\"message\":\"overloaded\"}}\n\n"
+
+	text, _, finishReason, _, _, err := parseSSEResponse(strings.NewReader(body))
+	if err == nil || !strings.Contains(err.Error(), "overloaded") {
+		t.Fatalf("expected the upstream error message, got %v", err)
+	}
+	if text != "Partial" || finishReason != "error" {
+		t.Errorf("got text %q, finish reason %q", text, finishReason)
+	}
+}
+
+func TestMapAnthropicStopReason(t *testing.T) {
+	tests := map[string]string{
+		"":               "end_turn",
+		"stop":           "end_turn",
+		"end_turn":       "end_turn",
+		"length":         "max_tokens",
+		"max_tokens":     "max_tokens",
+		"safety":         "refusal",
+		"content_filter": "refusal",
+	}
+	for finishReason, want := range tests {
+		if got := mapAnthropicStopReason(finishReason); got != want {
+			t.Errorf("mapAnthropicStopReason(%q) = %q, want %q", finishReason, got, want)
+		}
+	}
+}
+
+func TestAnthropicStreamingResponse(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		// Multi-line data must be joined before decoding
+		w.Write([]byte("data: {\"text\":\ndata: \"Hello\"}\n\n"))
+		writeSSE(w, RaycastSSEData{FinishReason: "max_tokens"})
+	})
+	config := newTestConfig(upstream.URL)
+	router := Router(&config)
+
+	recorder := doRequest(router, http.MethodPost, "/v1/messages", `{"model":"gpt-4o","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	body := recorder.Body.String()
+	if !strings.Contains(body, `"text":"Hello"`) {
+		t.Errorf("text delta missing from stream:\n%s", body)
+	}
+	if !strings.Contains(body, `"stop_reason":"max_tokens"`) {
+		t.Errorf("max_tokens stop reason missing from stream:\n%s", body)
+	}
+}
+
+func TestAnthropicStreamingErrorEvent(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hel"})
+		w.Write([]byte("event: error\ndata: {\"message\":\"overloaded\"}\n\n"))
+	})
+	config := newTestConfig(upstream.URL)
+	router := Router(&config)
+
+	recorder := doRequest(router, http.MethodPost, "/v1/messages", `{"model":"gpt-4o","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	body := recorder.Body.String()
+	if !strings.Contains(body, "event: error\n") || !strings.Contains(body, "overloaded") {
+		t.Errorf("error event missing from stream:\n%s", body)
+	}
+	if strings.Contains(body, "message_stop") {
+		t.Errorf("failed stream ended like a complete message:\n%s", body)
+	}
+}
+
+func TestMultilineTextPreserved(t *testing.T) {
+	chunks := []string{"Line one\nLine", " two\n\n", "data: not an event\r\n", "```go\nfmt.Println(\"hi\")\n```\n", "émoji 👋\n"}
+	want := strings.Join(chunks, "")
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		for _, chunk := range chunks {
+			writeSSE(w, RaycastSSEData{Text: chunk})
+		}
+		writeSSE(w, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	router := Router(&config)
+
+	// With and without coalescing of streamed text
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		config.CoalesceInterval = interval
+		w := doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true}`)
+		if got := streamedText(t, w.Body); got != want {
+			t.Errorf("streamed text with coalescing %v differs:\n got %q\nwant %q", interval, got, want)
+		}
+	}
+
+	w := doRequest(router, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if got := decodeCompletion(t, w.Body).Choices[0].Message.Content; got != want {
+		t.Errorf("completion text differs:\n got %q\nwant %q", got, want)
+	}
+}
+
+// legacyParseSSEResponse is the original parser, which scanned the whole response as a string
+// and concatenated the text, kept to check the current parser against it
+func legacyParseSSEResponse(responseText string) string {
+	scanner := bufio.NewScanner(strings.NewReader(responseText))
+	var fullText string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "data:") {
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			var jsonData RaycastSSEData
+			if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
+				continue
+			}
+			if jsonData.Text != "" {
+				fullText += jsonData.Text
+			}
+		}
+	}
+
+	return fullText
+}
+
+// longSSEResponse builds a response streaming about 100k characters of text in small chunks
+func longSSEResponse() string {
+	var body strings.Builder
+	for i := 0; i < 10000; i++ {
+		data, _ := json.Marshal(RaycastSSEData{Text: fmt.Sprintf("chunk %03d\n", i%1000)})
+		body.WriteString("data: " + string(data) + "\n\n")
+	}
+	body.WriteString(`data: {"finish_reason":"stop"}` + "\n\n")
+	return body.String()
+}
+
+func TestParseSSEResponseMatchesLegacy(t *testing.T) {
+	body := longSSEResponse()
+	text, _, finishReason, _, _, err := parseSSEResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("parseSSEResponse: %v", err)
+	}
+	if want := legacyParseSSEResponse(body); text != want || len(text) != 100000 {
+		t.Fatalf("got %d characters, the legacy parser %d", len(text), len(want))
+	}
+	if finishReason != "stop" {
+		t.Fatalf("expected finish reason stop, got %q", finishReason)
+	}
+}
+
+func BenchmarkParseSSEResponse(b *testing.B) {
+	body := longSSEResponse()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseSSEResponse(strings.NewReader(body))
+	}
+}
+
+func BenchmarkParseSSEResponseLegacy(b *testing.B) {
+	body := longSSEResponse()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyParseSSEResponse(body)
+	}
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stallingWriter accepts a number of writes and then blocks each write until its deadline,
+// like a client that stopped reading once the socket buffers are full
+type stallingWriter struct {
+	*httptest.ResponseRecorder
+	mutex    sync.Mutex
+	allowed  int
+	deadline time.Time
+}
+
+func (sw *stallingWriter) Write(data []byte) (int, error) {
+	sw.mutex.Lock()
+	if sw.allowed > 0 {
+		sw.allowed--
+		sw.mutex.Unlock()
+		return sw.ResponseRecorder.Write(data)
+	}
+	deadline := sw.deadline
+	sw.mutex.Unlock()
+
+	if deadline.IsZero() {
+		select {} // Without a deadline a stalled write never returns
+	}
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (sw *stallingWriter) WriteString(s string) (int, error) {
+	return sw.Write([]byte(s))
+}
+
+func (sw *stallingWriter) SetWriteDeadline(deadline time.Time) error {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.deadline = deadline
+	return nil
+}
+
+func (sw *stallingWriter) Flush() {}
+
+func TestStalledClientAbortsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		// Keep streaming until the proxy gives up on the response
+		timeout := time.After(10 * time.Second)
+		for {
+			writeSSE(w, RaycastSSEData{Text: "tick "})
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-timeout:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	config := newTestConfig(upstream.URL)
+	config.StreamWriteTimeout = 50 * time.Millisecond
+
+	resp, err := sendRaycastRequest(context.Background(), config, RaycastChatRequest{Model: "gpt-4o"}, nil)
+	if err != nil {
+		t.Fatalf("upstream request failed: %v", err)
+	}
+
+	writer := &stallingWriter{ResponseRecorder: httptest.NewRecorder(), allowed: 2}
+	c, _ := gin.CreateTestContext(writer)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	returned := make(chan struct{})
+	go func() {
+		handleStreamingResponse(c, resp, "gpt-4o", config, false)
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not abort after the write deadline")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("aborting the stream did not cancel the upstream request")
+	}
+}
+
+// pumpBody is an upstream body that fails with err once its data is read and records whether it was closed
+type pumpBody struct {
+	io.Reader
+	err    error
+	closed chan struct{}
+}
+
+func (pb *pumpBody) Read(p []byte) (int, error) {
+	n, err := pb.Reader.Read(p)
+	if err == io.EOF && pb.err != nil {
+		return n, pb.err
+	}
+	return n, err
+}
+
+func (pb *pumpBody) Close() error {
+	select {
+	case <-pb.closed:
+	default:
+		close(pb.closed)
+	}
+	return nil
+}
+
+func TestPumpSSEEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+		want []RaycastSSEData
+	}{
+		{"events in order", "data: {\"text\":\"Hel\"}\n\ndata: {\"text\":\"lo\"}\n\ndata: {\"finish_reason\":\"stop\"}\n\n", nil,
+			[]RaycastSSEData{{Text: "Hel"}, {Text: "lo"}, {FinishReason: "stop"}}},
+		{"malformed event skipped", "data: {\"text\":\"Hi\"}\n\ndata: {oops\n\ndata: {\"finish_reason\":\"stop\"}\n\n", nil,
+			[]RaycastSSEData{{Text: "Hi"}, {FinishReason: "stop"}}},
+		{"error event", "data: {\"text\":\"Hi\"}\n\nevent: error\ndata: {\"message\":\"overloaded\"}\n\n", nil,
+			[]RaycastSSEData{{Text: "Hi"}, {FinishReason: "error"}}},
+		{"read error", "data: {\"text\":\"Hi\"}\n\n", errors.New("connection reset"),
+			[]RaycastSSEData{{Text: "Hi"}, {FinishReason: "error"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &pumpBody{Reader: strings.NewReader(tt.body), err: tt.err, closed: make(chan struct{})}
+			// The buffer holds every event, so the pump finishes without waiting for a reader
+			events := make(chan RaycastSSEData, len(tt.want))
+			finished := make(chan struct{})
+			go func() {
+				pumpSSEEvents(body, events, make(chan struct{}))
+				close(finished)
+			}()
+			select {
+			case <-finished:
+			case <-time.After(5 * time.Second):
+				t.Fatal("pump blocked although the buffer had room for every event")
+			}
+
+			var got []RaycastSSEData
+			for event := range events {
+				got = append(got, event)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPumpSSEEventsStopsWhenDone(t *testing.T) {
+	// More events than the buffer holds, so the pump waits on the reader until done is closed
+	body := &pumpBody{Reader: strings.NewReader(strings.Repeat("data: {\"text\":\"Hi\"}\n\n", 10)), closed: make(chan struct{})}
+	events := make(chan RaycastSSEData, 2)
+	done := make(chan struct{})
+	go pumpSSEEvents(body, events, done)
+
+	<-events
+	close(done)
+	select {
+	case <-body.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream body was not closed after done")
+	}
+	for range events {
+	}
+}
+
+func TestStreamKeepalive(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		gap      time.Duration // Upstream pause before each event
+		want     bool
+	}{
+		{"idle upstream", 20 * time.Millisecond, 150 * time.Millisecond, true},
+		{"disabled", 0, 150 * time.Millisecond, false},
+		// Each event restarts the interval, so a steady stream gets none even when it outlasts one interval
+		{"busy upstream", 80 * time.Millisecond, 15 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+				for _, event := range []RaycastSSEData{{Text: "H"}, {Text: "e"}, {Text: "l"}, {Text: "l"}, {Text: "o"}, {Text: ""}, {FinishReason: "stop"}} {
+					time.Sleep(tt.gap)
+					writeSSE(w, event)
+				}
+			})
+			config := newTestConfig(upstream.URL)
+			config.KeepaliveInterval = tt.interval
+
+			w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+			body := w.Body.String()
+			if got := strings.Contains(body, ": keepalive\n\n"); got != tt.want {
+				t.Fatalf("expected keepalive comments %v, got:\n%s", tt.want, body)
+			}
+			// Keepalives are comments, so the content streams unchanged
+			if text := streamedText(t, strings.NewReader(body)); text != "Hello" {
+				t.Fatalf("expected %q, got %q", "Hello", text)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 14:20:37
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 14:20:37
+ * @FilePath: /raycast2api/service/token.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// TokenFile holds a bearer token read from a mounted secret file
+type TokenFile struct {
+	path  string
+	token string
+	mutex sync.RWMutex
+}
+
+// NewTokenFile reads the token from path
+func NewTokenFile(path string) (*TokenFile, error) {
+	tf := &TokenFile{path: path}
+	if err := tf.Reload(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Get returns the current token
+func (tf *TokenFile) Get() string {
+	tf.mutex.RLock()
+	defer tf.mutex.RUnlock()
+	return tf.token
+}
+
+// Reload re-reads the token file, keeping the previous token on error
+func (tf *TokenFile) Reload() error {
+	data, err := os.ReadFile(tf.path)
+	if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("token file %s is empty", tf.path)
+	}
+
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.token = token
+	return nil
+}
+
+// watchReload re-reads the token file every time the process receives SIGHUP, calling onReload after each successful reload
+func (tf *TokenFile) watchReload(onReload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := tf.Reload(); err != nil {
+				log.Printf("Failed to reload bearer token: %v", err)
+				continue
+			}
+			onReload()
+			log.Printf("Reloaded bearer token from %s", tf.path)
+		}
+	}()
+}
+
+// APIKeyFile holds client API keys read from a file, one per line or comma-separated
+type APIKeyFile struct {
+	path  string
+	keys  []string
+	mutex sync.RWMutex
+}
+
+// NewAPIKeyFile reads the API keys from path
+func NewAPIKeyFile(path string) (*APIKeyFile, error) {
+	kf := &APIKeyFile{path: path}
+	if err := kf.Reload(); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+// Keys returns the current API keys, nil for a nil key file
+func (kf *APIKeyFile) Keys() []string {
+	if kf == nil {
+		return nil
+	}
+
+	kf.mutex.RLock()
+	defer kf.mutex.RUnlock()
+	return kf.keys
+}
+
+// Reload re-reads the key file, keeping the previous keys on error.
+// Blank lines and lines starting with # are ignored.
+func (kf *APIKeyFile) Reload() error {
+	data, err := os.ReadFile(kf.path)
+	if err != nil {
+		return fmt.Errorf("error reading API key file: %w", err)
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, key := range strings.Split(line, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	// An empty file would disable authentication, so it is rejected
+	if len(keys) == 0 {
+		return fmt.Errorf("API key file %s has no keys", kf.path)
+	}
+
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	kf.keys = keys
+	return nil
+}
+
+// watchReload re-reads the key file every time the process receives SIGHUP
+func (kf *APIKeyFile) watchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := kf.Reload(); err != nil {
+				log.Printf("Failed to reload API keys: %v", err)
+				continue
+			}
+			log.Printf("Reloaded %d API keys from %s", len(kf.Keys()), kf.path)
+		}
+	}()
+}
+
+// TokenRefresher fetches a fresh bearer token from an external endpoint when Raycast rejects the current one
+type TokenRefresher struct {
+	url      string
+	method   string
+	token    string        // Empty until the first refresh
+	inflight *tokenRefresh // The refresh in progress, nil when there is none
+	mutex    sync.RWMutex
+}
+
+// tokenRefresh is a refresh shared by the requests waiting on it
+type tokenRefresh struct {
+	done chan struct{} // Closed when the refresh has finished
+	err  error
+}
+
+// NewTokenRefresher creates a token refresher calling url with method
+func NewTokenRefresher(url string, method string) *TokenRefresher {
+	return &TokenRefresher{url: url, method: method}
+}
+
+// Get returns the refreshed token, or an empty string if no refresh has happened yet or refreshing is disabled
+func (tr *TokenRefresher) Get() string {
+	if tr == nil {
+		return ""
+	}
+
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	return tr.token
+}
+
+// Reset drops the refreshed token, so the configured token is used until the next refresh.
+// It is a no-op on a nil refresher.
+func (tr *TokenRefresher) Reset() {
+	if tr == nil {
+		return
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.token = ""
+}
+
+// Refresh replaces staleToken with one fetched from the refresh endpoint.
+// Concurrent callers share a single refresh, and the lock is only held to read and swap the token,
+// so requests keep using the current token while the refresh endpoint is called.
+func (tr *TokenRefresher) Refresh(client *http.Client, staleToken string) error {
+	tr.mutex.Lock()
+	if tr.token != "" && tr.token != staleToken {
+		tr.mutex.Unlock()
+		return nil // Already refreshed by another request
+	}
+	if refresh := tr.inflight; refresh != nil {
+		tr.mutex.Unlock()
+		<-refresh.done
+		return refresh.err
+	}
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	tr.inflight = refresh
+	tr.mutex.Unlock()
+
+	token, err := tr.fetch(client)
+	tr.mutex.Lock()
+	if err == nil {
+		tr.token = token
+	}
+	tr.inflight = nil
+	tr.mutex.Unlock()
+
+	refresh.err = err
+	close(refresh.done)
+	if err == nil {
+		log.Println("Refreshed bearer token")
+	}
+	return err
+}
+
+// fetch calls the refresh endpoint and returns the new token
+func (tr *TokenRefresher) fetch(client *http.Client) (string, error) {
+	req, err := http.NewRequest(tr.method, tr.url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating refresh request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling token refresh url: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("error reading refreshed token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token refresh url returned %d", resp.StatusCode)
+	}
+
+	token := parseRefreshedToken(body)
+	if token == "" {
+		return "", fmt.Errorf("token refresh url returned no token")
+	}
+	return token, nil
+}
+
+// parseRefreshedToken accepts either a plain text token or a JSON object with a token or access_token field
+func parseRefreshedToken(body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(text, "{") {
+		return text
+	}
+
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(text), &response); err != nil {
+		return ""
+	}
+	if response.Token != "" {
+		return response.Token
+	}
+	return response.AccessToken
+}
+
+// bearerToken returns the Raycast bearer token, preferring a refreshed token, then the token file.
+// Reloading the token file drops the refreshed token, so a rotated file takes effect.
+func (config Config) bearerToken() string {
+	if token := config.TokenRefresher.Get(); token != "" {
+		return token
+	}
+	if config.TokenFile != nil {
+		return config.TokenFile.Get()
+	}
+	return config.RaycastBearerToken
+}
+
+// apiKeys returns the client API keys from API_KEY and API_KEY_FILE
+func (config Config) apiKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(config.APIKey, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return append(keys, config.APIKeyFile.Keys()...)
+}
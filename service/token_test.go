@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTokenFileReloadReplacesRefreshedToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("file-token-1\n"), 0o600)
+	tokenFile, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"refreshed-token"}`)
+	}))
+	defer refreshServer.Close()
+
+	config := Config{TokenFile: tokenFile, TokenRefresher: NewTokenRefresher(refreshServer.URL, http.MethodGet)}
+	tokenFile.watchReload(func() { config.TokenRefresher.Reset() })
+
+	if token := config.bearerToken(); token != "file-token-1" {
+		t.Fatalf("got %q before refreshing, want the file token", token)
+	}
+	if err := config.TokenRefresher.Refresh(http.DefaultClient, "file-token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if token := config.bearerToken(); token != "refreshed-token" {
+		t.Fatalf("got %q after refreshing, want the refreshed token", token)
+	}
+
+	// Rotating the file and sending SIGHUP switches back to the file
+	os.WriteFile(path, []byte("file-token-2\n"), 0o600)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(5 * time.Second)
+	for config.bearerToken() != "file-token-2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q after reloading, want the rotated file token", config.bearerToken())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The rotated token can itself be refreshed again
+	if err := config.TokenRefresher.Refresh(http.DefaultClient, "file-token-2"); err != nil {
+		t.Fatal(err)
+	}
+	if token := config.bearerToken(); token != "refreshed-token" {
+		t.Fatalf("got %q after the second refresh, want the refreshed token", token)
+	}
+}
+
+func TestTokenFileRejectsEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("token\n"), 0o600)
+	tokenFile, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("  \n"), 0o600)
+	if err := tokenFile.Reload(); err == nil {
+		t.Fatal("empty token file was accepted")
+	}
+	if token := tokenFile.Get(); token != "token" {
+		t.Fatalf("got %q, want the previous token kept", token)
+	}
+}
+
+func TestUnauthorizedRefreshesAndRetries(t *testing.T) {
+	refreshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fresh-token")
+	}))
+	defer refreshServer.Close()
+
+	var tokens []string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer fresh-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	config.TokenRefresher = NewTokenRefresher(refreshServer.URL, http.MethodGet)
+
+	resp, err := sendRaycastRequest(context.Background(), config, RaycastChatRequest{Model: "gpt-4o"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d", resp.StatusCode)
+	}
+	if len(tokens) != 2 || tokens[0] != "Bearer test-token" || tokens[1] != "Bearer fresh-token" {
+		t.Fatalf("expected the stale token and then the refreshed one, got %q", tokens)
+	}
+}
+
+func TestTokenRefreshIsShared(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	refreshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+		fmt.Fprint(w, "fresh-token")
+	}))
+	defer refreshServer.Close()
+
+	refresher := NewTokenRefresher(refreshServer.URL, http.MethodGet)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- refresher.Refresh(http.DefaultClient, "stale-token") }()
+	}
+
+	// The token stays readable while the refresh endpoint is slow
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	read := make(chan string)
+	go func() { read <- refresher.Get() }()
+	select {
+	case token := <-read:
+		if token != "" {
+			t.Fatalf("expected no token before the refresh finished, got %q", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reading the token blocked on the refresh")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one refresh call, got %d", calls.Load())
+	}
+	if token := refresher.Get(); token != "fresh-token" {
+		t.Fatalf("expected the refreshed token, got %q", token)
+	}
+}
+
+func TestAPIKeyFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(path, []byte("old-key\n"), 0o600)
+	keyFile, err := NewAPIKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile.watchReload()
+
+	upstream := newTestUpstream(t, nil)
+	config := newTestConfig(upstream.URL)
+	config.APIKeyFile = keyFile
+	router := Router(&config)
+
+	if recorder := doRequest(router, http.MethodGet, "/v1/models", "", "Authorization", "Bearer old-key"); recorder.Code != http.StatusOK {
+		t.Fatalf("old key before reloading: got %d, want 200", recorder.Code)
+	}
+
+	// Rotating the file and sending SIGHUP swaps the accepted keys without a restart
+	os.WriteFile(path, []byte("# rotated\nnew-key, other-key\n"), 0o600)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(keyFile.Keys()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got keys %v after reloading, want the rotated keys", keyFile.Keys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"old key", "old-key", http.StatusUnauthorized},
+		{"new key", "new-key", http.StatusOK},
+		{"comma-separated key", "other-key", http.StatusOK},
+		{"comment line", "# rotated", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if recorder := doRequest(router, http.MethodGet, "/v1/models", "", "Authorization", "Bearer "+tt.key); recorder.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, recorder.Code, tt.want)
+		}
+	}
+
+	// An emptied file is rejected and the previous keys stay in effect
+	os.WriteFile(path, []byte("\n"), 0o600)
+	if err := keyFile.Reload(); err == nil {
+		t.Fatal("expected reloading an empty key file to fail")
+	}
+	if recorder := doRequest(router, http.MethodGet, "/v1/models", "", "Authorization", "Bearer new-key"); recorder.Code != http.StatusOK {
+		t.Errorf("new key after a failed reload: got %d, want 200", recorder.Code)
+	}
+}
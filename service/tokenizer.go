@@ -0,0 +1,119 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 22:41:07
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 22:41:07
+ * @FilePath: /raycast2api/service/tokenizer.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// TokenizerEncodings maps OpenAI model ID prefixes to their tiktoken encoding, checked in order
+var TokenizerEncodings = []struct {
+	Prefix   string
+	Encoding string
+}{
+	{"gpt-4o", "o200k_base"},
+	{"chatgpt-4o", "o200k_base"},
+	{"gpt-4.1", "o200k_base"},
+	{"gpt-4.5", "o200k_base"},
+	{"gpt-5", "o200k_base"},
+	{"o1", "o200k_base"},
+	{"o3", "o200k_base"},
+	{"o4", "o200k_base"},
+	{"gpt-4", "cl100k_base"},
+	{"gpt-3.5", "cl100k_base"},
+}
+
+// Tokens OpenAI's chat format adds around each message, besides its role, and to prime the reply
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// Encoders are built on first use and shared, building one takes a while
+var (
+	encoders      = map[string]*tiktoken.Tiktoken{}
+	encodersMutex sync.Mutex
+)
+
+func init() {
+	// Load the BPE ranks embedded in the binary instead of downloading them
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Tokenizer counts tokens the way a model does, with its BPE encoding for OpenAI models and
+// about 4 characters per token for providers without a known tokenizer. The zero value estimates.
+type Tokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// NewTokenizer returns the tokenizer of a Raycast provider and model
+func NewTokenizer(provider string, model string) Tokenizer {
+	if provider != "openai" && provider != "azure_openai" {
+		return Tokenizer{}
+	}
+	for _, entry := range TokenizerEncodings {
+		if strings.HasPrefix(model, entry.Prefix) {
+			return Tokenizer{encoding: encoder(entry.Encoding)}
+		}
+	}
+	return Tokenizer{}
+}
+
+// encoder returns the shared encoder for a tiktoken encoding, nil when it cannot be built
+func encoder(name string) *tiktoken.Tiktoken {
+	encodersMutex.Lock()
+	defer encodersMutex.Unlock()
+
+	if encoding, ok := encoders[name]; ok {
+		return encoding
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		log.Printf("Error loading tokenizer %s, estimating tokens instead: %v", name, err)
+	}
+	encoders[name] = encoding
+	return encoding
+}
+
+// Count returns the number of tokens in text
+func (t Tokenizer) Count(text string) int {
+	if t.encoding == nil {
+		return estimateTokens(text)
+	}
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// CountPrompt returns the prompt tokens of a converted conversation. With a known
+// tokenizer this includes the tokens OpenAI's chat format adds around the messages.
+func (t Tokenizer) CountPrompt(messageResult ConvertMessagesResult) int {
+	tokens := t.Count(messageResult.SystemInstruction)
+	for _, msg := range messageResult.RaycastMessages {
+		tokens += t.Count(msg.Content.Text)
+	}
+	if t.encoding == nil {
+		return tokens
+	}
+
+	if messageResult.SystemInstruction != "" {
+		tokens += tokensPerMessage + t.Count("system")
+	}
+	for _, msg := range messageResult.RaycastMessages {
+		tokens += tokensPerMessage + t.Count(msg.Author)
+	}
+	return tokens + tokensPerReply
+}
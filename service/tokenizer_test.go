@@ -0,0 +1,70 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTokenizerCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		model    string
+		text     string
+		want     int
+	}{
+		{"cl100k", "openai", "gpt-4", "tiktoken is great!", 6},
+		{"cl100k word split", "openai", "gpt-3.5-turbo", "antidisestablishmentarianism", 6},
+		{"o200k", "openai", "gpt-4o", "hello world", 2},
+		{"o200k dated model", "azure_openai", "gpt-4o-2024-08-06", "hello world", 2},
+		{"o-series", "openai", "o3-mini", "hello world", 2},
+		{"special tokens counted as text", "openai", "gpt-4o", "<|endoftext|>", 7},
+		{"unknown provider estimates", "anthropic", "claude-sonnet", "tiktoken is great!", 5},
+		{"unknown OpenAI model estimates", "openai", "dall-e-3", "hello world", 3},
+		{"empty", "openai", "gpt-4o", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewTokenizer(tt.provider, tt.model).Count(tt.text); got != tt.want {
+				t.Fatalf("expected %d tokens, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTokenizerCountPrompt(t *testing.T) {
+	messageResult := convertMessages([]OpenAIMessage{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "hello world"},
+	}, "")
+
+	// 6 system tokens and 2 user tokens, 3 per message plus its role, and 3 to prime the reply
+	if got := NewTokenizer("openai", "gpt-4o").CountPrompt(messageResult); got != 6+2+2*(3+1)+3 {
+		t.Fatalf("expected 19 prompt tokens, got %d", got)
+	}
+	// Without a tokenizer only the text is estimated
+	if got := (Tokenizer{}).CountPrompt(messageResult); got != 7+3 {
+		t.Fatalf("expected 10 estimated prompt tokens, got %d", got)
+	}
+}
+
+func TestCompletionUsage(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "hello world"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+
+	w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions",
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hello world"}]}`)
+	usage := decodeCompletion(t, w.Body).Usage
+	if usage.PromptTokens != 2+(3+1)+3 || usage.CompletionTokens != 2 || usage.TotalTokens != usage.PromptTokens+2 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	w = doRequest(Router(&config), http.MethodPost, "/v1/messages",
+		`{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"hello world"}]}`, "anthropic-version", "2023-06-01")
+	if !strings.Contains(w.Body.String(), `"usage":{"input_tokens":`) || strings.Contains(w.Body.String(), `"output_tokens":0`) {
+		t.Fatalf("Anthropic response has no usage: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 20:14:52
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 20:14:52
+ * @FilePath: /raycast2api/service/tracing.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TraceShutdownTimeout is how long the remaining spans get to be exported on shutdown
+const TraceShutdownTimeout = 10 * time.Second
+
+// Tracer records a span per request and per upstream call and exports them in batches
+// to an OpenTelemetry collector over OTLP/HTTP
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a tracer exporting to the collector at endpoint, the base URL of an OTLP/HTTP receiver
+func NewTracer(endpoint string, serviceName string) (*Tracer, error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %w", err)
+	}
+	return newTracer(sdktrace.WithBatcher(exporter), serviceName), nil
+}
+
+// newTracer creates a tracer handing finished spans to the span processor set by processor.
+// Sampling follows the incoming trace context, requests without one are always sampled.
+func newTracer(processor sdktrace.TracerProviderOption, serviceName string) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	return &Tracer{
+		provider:   provider,
+		tracer:     provider.Tracer("raycast2api", trace.WithInstrumentationVersion(Version)),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// StartRequestSpan starts a server span for an incoming request, continuing the trace from its
+// W3C traceparent and tracestate headers when present. The returned context carries the span.
+// A nil tracer returns the request context and a no-op span.
+func (t *Tracer) StartRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	if t == nil {
+		return r.Context(), noop.Span{}
+	}
+
+	ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return t.tracer.Start(ctx, r.Method+" "+r.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+}
+
+// StartUpstreamSpan starts a client span for a call to Raycast as a child of the span in ctx.
+// A nil tracer returns ctx and a no-op span.
+func (t *Tracer) StartUpstreamSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// Shutdown exports the remaining spans and stops the tracer. It is a no-op on a nil tracer.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TraceShutdownTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("Error exporting remaining spans: %v", err)
+	}
+}
+
+// endSpan finishes a span with an HTTP status code, 0 when the request failed without a response.
+// Statuses of 500 and above, and 0, mark the span as an error.
+func endSpan(span trace.Span, statusCode int) {
+	if statusCode > 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+	}
+	if statusCode == 0 || statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
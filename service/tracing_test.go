@@ -0,0 +1,115 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestTracer returns a tracer recording finished spans in memory
+func newTestTracer() (*Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return newTracer(sdktrace.WithSyncer(exporter), "test"), exporter
+}
+
+// findSpan returns the recorded span named name, failing the test if there is none
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span named %q in %d recorded spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func tracedChatRequest(t *testing.T, headers ...string) tracetest.SpanStubs {
+	t.Helper()
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request, req RaycastChatRequest) {
+		writeSSE(w, RaycastSSEData{Text: "Hi"}, RaycastSSEData{FinishReason: "stop"})
+	})
+	config := newTestConfig(upstream.URL)
+	tracer, exporter := newTestTracer()
+	config.Tracer = tracer
+
+	w := doRequest(Router(&config), http.MethodPost, "/v1/chat/completions",
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`, headers...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	return exporter.GetSpans()
+}
+
+func TestTracingContinuesIncomingTrace(t *testing.T) {
+	spans := tracedChatRequest(t, "traceparent", testTraceparent, "tracestate", "vendor=abc")
+
+	server := findSpan(t, spans, "POST /v1/chat/completions")
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("expected a server span, got %v", server.SpanKind)
+	}
+	if got := server.Parent.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID not continued, got %s", got)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span ID not continued, got %s", got)
+	}
+	if !server.Parent.IsRemote() {
+		t.Error("parent span not marked remote")
+	}
+	if got := server.SpanContext.TraceState().String(); got != "vendor=abc" {
+		t.Errorf("tracestate not preserved, got %q", got)
+	}
+
+	upstream := findSpan(t, spans, "raycast.chat")
+	if upstream.SpanKind != trace.SpanKindClient {
+		t.Errorf("expected a client span, got %v", upstream.SpanKind)
+	}
+	if upstream.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("upstream span is not a child of the request span")
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range server.Attributes {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["gen_ai.request.model"] != "gpt-4o" || attributes["http.response.status_code"] != "200" {
+		t.Errorf("missing request attributes: %v", attributes)
+	}
+}
+
+func TestTracingStartsNewTrace(t *testing.T) {
+	spans := tracedChatRequest(t)
+
+	server := findSpan(t, spans, "POST /v1/chat/completions")
+	if server.Parent.IsValid() {
+		t.Errorf("request without traceparent has a parent %s", server.Parent.SpanID())
+	}
+	if !server.SpanContext.IsSampled() {
+		t.Error("request without traceparent was not sampled")
+	}
+}
+
+func TestTracingHonorsUnsampledParent(t *testing.T) {
+	unsampled := strings.TrimSuffix(testTraceparent, "01") + "00"
+	if spans := tracedChatRequest(t, "traceparent", unsampled); len(spans) != 0 {
+		t.Fatalf("expected no spans for an unsampled trace, got %d", len(spans))
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	req, _ := http.NewRequest(http.MethodGet, "/health", nil)
+	ctx, span := tracer.StartRequestSpan(req)
+	if ctx != req.Context() || span.IsRecording() {
+		t.Fatal("nil tracer started a recording span")
+	}
+	endSpan(span, http.StatusOK)
+	tracer.Shutdown()
+}
@@ -14,8 +14,10 @@ package service
 
 // OpenAIMessage represents a message in OpenAI format
 type OpenAIMessage struct {
-	Role    string      `json:"role"`    // "user", "assistant", or "system"
-	Content interface{} `json:"content"` // Can be string or array
+	Role       string      `json:"role"`                   // "user", "assistant", "system", "tool" or "function"
+	Content    interface{} `json:"content"`                // Can be string or array
+	Name       string      `json:"name,omitempty"`         // Optional speaker label, or the function name for function results
+	ToolCallID string      `json:"tool_call_id,omitempty"` // Set on tool results
 }
 
 // RaycastMessage represents a message in Raycast format
@@ -28,29 +30,99 @@ type RaycastMessage struct {
 
 // RaycastChatRequest represents a chat request to Raycast API
 type RaycastChatRequest struct {
-	AdditionalSystemInstructions string           `json:"additional_system_instructions"`
-	Debug                        bool             `json:"debug"`
-	Locale                       string           `json:"locale"`
-	Messages                     []RaycastMessage `json:"messages"`
-	Model                        string           `json:"model"`
-	Provider                     string           `json:"provider"`
-	Source                       string           `json:"source"`
-	SystemInstruction            string           `json:"system_instruction"`
-	Temperature                  float64          `json:"temperature"`
-	ThreadID                     string           `json:"thread_id"`
-	Tools                        []struct {
-		Name string `json:"name"`
-		Type string `json:"type"`
-	} `json:"tools"`
+	AdditionalSystemInstructions string             `json:"additional_system_instructions"`
+	Debug                        bool               `json:"debug"`
+	Locale                       string             `json:"locale"`
+	Messages                     []RaycastMessage   `json:"messages"`
+	Model                        string             `json:"model"`
+	Provider                     string             `json:"provider"`
+	Source                       string             `json:"source"`
+	SystemInstruction            string             `json:"system_instruction"`
+	Temperature                  float64            `json:"temperature"`
+	MaxTokens                    int                `json:"max_tokens,omitempty"`
+	LogitBias                    map[string]float64 `json:"logit_bias,omitempty"`
+	Seed                         *int64             `json:"seed,omitempty"`
+	Logprobs                     bool               `json:"logprobs,omitempty"`
+	TopLogprobs                  *int               `json:"top_logprobs,omitempty"`
+	ReasoningEffort              string             `json:"reasoning_effort,omitempty"`
+	Thinking                     *ThinkingConfig    `json:"thinking,omitempty"`
+	ThreadID                     string             `json:"thread_id"`
+	Tools                        []RaycastTool      `json:"tools"`
+}
+
+// RaycastTool represents a built-in Raycast tool enabled for a request
+type RaycastTool struct {
+	Name string `json:"name"` // e.g. "web_search"
+	Type string `json:"type"` // "remote_tool"
 }
 
 // OpenAIChatRequest represents a chat request in OpenAI format
 type OpenAIChatRequest struct {
-	Messages    []OpenAIMessage        `json:"messages"`
-	Model       string                 `json:"model"`
-	Temperature float64                `json:"temperature,omitempty"`
-	Stream      bool                   `json:"stream,omitempty"`
-	Extra       map[string]interface{} `json:"-"`
+	Messages                     []OpenAIMessage    `json:"messages"`
+	Model                        string             `json:"model"`
+	Temperature                  *float64           `json:"temperature,omitempty"`           // nil uses the default, 0 is sent as is
+	TopP                         *float64           `json:"top_p,omitempty"`                 // Validated in strict mode, not forwarded
+	PresencePenalty              *float64           `json:"presence_penalty,omitempty"`      // Validated in strict mode, not forwarded
+	FrequencyPenalty             *float64           `json:"frequency_penalty,omitempty"`     // Validated in strict mode, not forwarded
+	N                            *int               `json:"n,omitempty"`                     // Validated in strict mode, only one choice is returned
+	MaxTokens                    int                `json:"max_tokens,omitempty"`            // Deprecated by OpenAI in favor of max_completion_tokens
+	MaxCompletionTokens          int                `json:"max_completion_tokens,omitempty"` // Takes precedence over max_tokens
+	LogitBias                    map[string]float64 `json:"logit_bias,omitempty"`            // Token ID to bias in [-100, 100]
+	Seed                         *int64             `json:"seed,omitempty"`
+	Logprobs                     bool               `json:"logprobs,omitempty"`                       // Forwarded to providers that support it
+	TopLogprobs                  *int               `json:"top_logprobs,omitempty"`                   // 0 to 20, requires logprobs
+	AdditionalSystemInstructions string             `json:"additional_system_instructions,omitempty"` // Raycast extension for per-request guidance
+	ReasoningEffort              string             `json:"reasoning_effort,omitempty"`               // "low", "medium" or "high" for reasoning models
+	Thinking                     *ThinkingConfig    `json:"thinking,omitempty"`                       // Extended thinking budget for Anthropic and Gemini models
+	ResponseFormat               *ResponseFormat    `json:"response_format,omitempty"`
+	Store                        *bool              `json:"store,omitempty"`             // Accepted for SDK compatibility, completions are never stored
+	Metadata                     map[string]string  `json:"metadata,omitempty"`          // Recorded in the audit log
+	IncludeReasoning             bool               `json:"include_reasoning,omitempty"` // Return the model's reasoning trace as reasoning_content
+	Tools                        []OpenAITool       `json:"tools,omitempty"`
+	WebSearch                    bool               `json:"web_search,omitempty"`       // Shorthand for a web_search tool
+	FlattenMessages              bool               `json:"flatten_messages,omitempty"` // Send the conversation as a single user message
+	Provider                     string             `json:"provider,omitempty"`         // Pin the Raycast provider, overrides X-Provider
+	Stream                       bool               `json:"stream,omitempty"`
+}
+
+// ThinkingConfig represents an extended thinking budget
+type ThinkingConfig struct {
+	Type         string `json:"type"` // "enabled" or "disabled"
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// OpenAITool represents a tool definition in OpenAI format.
+// Only built-in tools such as web_search are forwarded, function tools are ignored.
+type OpenAITool struct {
+	Type string `json:"type"` // "function", "web_search" or "web_search_preview"
+}
+
+// Annotation represents a citation attached to a response message
+type Annotation struct {
+	Type        string      `json:"type"` // "url_citation"
+	URLCitation URLCitation `json:"url_citation"`
+}
+
+// URLCitation represents a web source cited by the response
+type URLCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+}
+
+// ResponseFormat represents the requested output format
+type ResponseFormat struct {
+	Type       string            `json:"type"` // "text", "json_object" or "json_schema"
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat represents the schema of a json_schema response format
+type JSONSchemaFormat struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      *bool                  `json:"strict,omitempty"` // Accepted for compatibility, responses are always validated
 }
 
 // OpenAIChatResponse represents a chat response in OpenAI format
@@ -62,13 +134,14 @@ type OpenAIChatResponse struct {
 	Choices []struct {
 		Index   int `json:"index"`
 		Message struct {
-			Role        string   `json:"role"`
-			Content     string   `json:"content"`
-			Refusal     *string  `json:"refusal"`
-			Annotations []string `json:"annotations"`
+			Role             string       `json:"role"`
+			Content          string       `json:"content"`
+			ReasoningContent string       `json:"reasoning_content,omitempty"`
+			Refusal          *string      `json:"refusal"`
+			Annotations      []Annotation `json:"annotations"`
 		} `json:"message"`
-		Logprobs     *string `json:"logprobs"`
-		FinishReason string  `json:"finish_reason"`
+		Logprobs     *ChoiceLogprobs `json:"logprobs"`
+		FinishReason string          `json:"finish_reason"`
 	} `json:"choices"`
 	Usage struct {
 		PromptTokens        int `json:"prompt_tokens"`
@@ -86,22 +159,136 @@ type OpenAIChatResponse struct {
 		} `json:"completion_tokens_details"`
 	} `json:"usage"`
 	ServiceTier       string `json:"service_tier"`
+	Provider          string `json:"provider,omitempty"` // Non-standard, only set in debug mode
 	SystemFingerprint string `json:"system_fingerprint"`
 }
 
+// ChoiceLogprobs represents the token log probabilities of a choice in OpenAI format
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+// TokenLogprob represents the log probability of an output token and its most likely alternatives
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob represents one of the most likely tokens at a position
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// OpenAIChatChunk represents a streaming chat completion chunk in OpenAI format
+type OpenAIChatChunk struct {
+	ID       string              `json:"id"`
+	Object   string              `json:"object"`
+	Created  int64               `json:"created"`
+	Model    string              `json:"model"`
+	Choices  []OpenAIChunkChoice `json:"choices"`
+	Provider string              `json:"provider,omitempty"` // Non-standard, only set in debug mode
+}
+
+// OpenAIChunkChoice represents a choice in a streaming chunk
+type OpenAIChunkChoice struct {
+	Index        int              `json:"index"`
+	Delta        OpenAIChunkDelta `json:"delta"`
+	FinishReason *string          `json:"finish_reason"` // null until the final chunk
+}
+
+// OpenAIChunkDelta represents the incremental content of a streaming chunk
+type OpenAIChunkDelta struct {
+	Content          string       `json:"content,omitempty"`
+	ReasoningContent string       `json:"reasoning_content,omitempty"`
+	Annotations      []Annotation `json:"annotations,omitempty"`
+}
+
 // RaycastSSEData represents SSE data from Raycast
 type RaycastSSEData struct {
-	Text         string `json:"text,omitempty"`
-	FinishReason string `json:"finish_reason,omitempty"`
+	Text         string            `json:"text,omitempty"`
+	Reasoning    string            `json:"reasoning,omitempty"` // Thinking trace from reasoning models
+	Citations    []RaycastCitation `json:"citations,omitempty"` // Sources returned by web search
+	FinishReason string            `json:"finish_reason,omitempty"`
+	Logprobs     []TokenLogprob    `json:"logprobs,omitempty"` // Only from providers that return token log probabilities
+}
+
+// RaycastCitation represents a web source returned by Raycast
+type RaycastCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	StartIndex int    `json:"start_index,omitempty"`
+	EndIndex   int    `json:"end_index,omitempty"`
+}
+
+// VersionInfo describes the running build
+type VersionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
 }
 
 // OpenAIModelResponse represents a model list response in OpenAI format
 type OpenAIModelResponse struct {
 	Object string `json:"object"`
 	Data   []struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		OwnedBy string `json:"owned_by"`
+		ID            string   `json:"id"`
+		Object        string   `json:"object"`
+		Created       int64    `json:"created"`
+		OwnedBy       string   `json:"owned_by"`
+		ContextWindow int      `json:"context_window,omitempty"`
+		Capabilities  []string `json:"capabilities,omitempty"`
+		Type          string   `json:"type,omitempty"`
 	} `json:"data"`
+	HasMore bool `json:"has_more"` // True when ?limit= cut the list short
+}
+
+// AnthropicMessage represents a message in Anthropic format
+type AnthropicMessage struct {
+	Role    string      `json:"role"`    // "user" or "assistant"
+	Content interface{} `json:"content"` // Can be string or array of content blocks
+}
+
+// AnthropicMessagesRequest represents a messages request in Anthropic format
+type AnthropicMessagesRequest struct {
+	Model       string             `json:"model"`
+	System      interface{}        `json:"system,omitempty"` // Can be string or array of content blocks
+	Messages    []AnthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float64           `json:"temperature,omitempty"` // nil uses the default, 0 is sent as is
+	Provider    string             `json:"provider,omitempty"`    // Pin the Raycast provider, overrides X-Provider
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+// AnthropicContentBlock represents a content block in Anthropic format
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// AnthropicMessagesResponse represents a messages response in Anthropic format
+type AnthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// AnthropicErrorResponse represents an error response in Anthropic format
+type AnthropicErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
 }
@@ -0,0 +1,102 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 17:58:44
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 17:58:44
+ * @FilePath: /raycast2api/service/usage.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// UsageStatus represents normalized Raycast quota usage
+type UsageStatus struct {
+	Object  string  `json:"object"` // Always "usage"
+	Used    *int64  `json:"used"`
+	Limit   *int64  `json:"limit"`
+	ResetAt *string `json:"reset_at"` // RFC 3339, null if unknown
+}
+
+// fetchUsage queries the Raycast usage endpoint and normalizes the response
+func fetchUsage(config Config) (*UsageStatus, error) {
+	req, err := http.NewRequest("GET", config.UsageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	for key, value := range getRaycastHeaders(config) {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := config.ModelsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching usage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("raycast api error, %s", upstreamErrorDetails(config, resp.StatusCode, bodyBytes))
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing usage response: %w", err)
+	}
+	return normalizeUsage(raw), nil
+}
+
+// normalizeUsage picks the used amount, limit and reset time out of a usage response,
+// accepting the field names commonly used for each
+func normalizeUsage(raw map[string]interface{}) *UsageStatus {
+	usage := &UsageStatus{Object: "usage"}
+
+	for _, key := range []string{"used", "usage", "requests_used", "count"} {
+		if number, ok := raw[key].(float64); ok {
+			used := int64(number)
+			usage.Used = &used
+			break
+		}
+	}
+	for _, key := range []string{"limit", "quota", "requests_limit", "max"} {
+		if number, ok := raw[key].(float64); ok {
+			limit := int64(number)
+			usage.Limit = &limit
+			break
+		}
+	}
+	for _, key := range []string{"reset_at", "resets_at", "reset", "reset_time"} {
+		var resetAt time.Time
+		switch value := raw[key].(type) {
+		case string:
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				continue
+			}
+			resetAt = parsed
+		case float64:
+			resetAt = time.Unix(int64(value), 0) // Unix seconds
+		default:
+			continue
+		}
+		formatted := resetAt.UTC().Format(time.RFC3339)
+		usage.ResetAt = &formatted
+		break
+	}
+
+	return usage
+}
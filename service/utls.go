@@ -14,16 +14,25 @@ package service
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ConvertMessagesResult represents the result of converting OpenAI messages
@@ -32,55 +41,42 @@ type ConvertMessagesResult struct {
 	SystemInstruction string
 }
 
-// convertMessages converts OpenAI messages format to Raycast format and extracts system instruction
-func convertMessages(openaiMessages []OpenAIMessage) ConvertMessagesResult {
-	systemInstruction := "markdown" // Default
+// convertMessages converts OpenAI messages format to Raycast format and extracts system instruction.
+// defaultInstruction is used when the first message is not a system message.
+// It never fails, malformed messages are handled as follows:
+//   - a message with a missing or unknown role is dropped
+//   - a system message after the first message is dropped
+//   - a first system message whose content has no text keeps defaultInstruction
+//   - a message whose content has no text, such as null or only images, is kept with empty text
+//   - a tool result without a name or tool_call_id is labelled as an unnamed tool result
+//
+// Content of any shape is reduced to text by messageContentText.
+func convertMessages(openaiMessages []OpenAIMessage, defaultInstruction string) ConvertMessagesResult {
+	systemInstruction := defaultInstruction
 	var raycastMessages []RaycastMessage
 
 	for i, msg := range openaiMessages {
 		if msg.Role == "system" && i == 0 {
-			// Extract the first system message as system instruction
-			switch content := msg.Content.(type) {
-			case string:
-				systemInstruction = content
-			case []interface{}:
-				// Handle array content (extract text parts)
-				var contentText string
-				for _, part := range content {
-					if partMap, ok := part.(map[string]interface{}); ok {
-						if partMap["type"] == "text" {
-							if textValue, ok := partMap["text"].(string); ok {
-								contentText += textValue
-							}
-						}
-					}
-				}
-				if contentText != "" {
-					systemInstruction = contentText
-				}
+			// Extract the first system message as system instruction, an empty array keeps the default
+			if text, ok := msg.Content.(string); ok {
+				systemInstruction = text
+			} else if text := messageContentText(msg.Content); text != "" {
+				systemInstruction = text
 			}
-		} else if msg.Role == "user" || msg.Role == "assistant" {
-			// Only include user and assistant messages in the messages array
+		} else if msg.Role == "user" || msg.Role == "assistant" || msg.Role == "tool" || msg.Role == "function" {
+			// Raycast only knows user and assistant turns, so tool results are sent as user turns
 			author := "user"
 			if msg.Role == "assistant" {
 				author = "assistant"
 			}
 
-			var contentText string
-			switch content := msg.Content.(type) {
-			case string:
-				contentText = content
-			case []interface{}:
-				// Handle array content (extract text parts)
-				for _, part := range content {
-					if partMap, ok := part.(map[string]interface{}); ok {
-						if partMap["type"] == "text" {
-							if textValue, ok := partMap["text"].(string); ok {
-								contentText += textValue
-							}
-						}
-					}
-				}
+			contentText := messageContentText(msg.Content)
+
+			// Raycast has no speaker field, so label named messages inline
+			if msg.Role == "tool" || msg.Role == "function" {
+				contentText = toolResultText(msg, contentText)
+			} else if msg.Name != "" {
+				contentText = msg.Name + ": " + contentText
 			}
 
 			raycastMessages = append(raycastMessages, RaycastMessage{
@@ -101,140 +97,969 @@ func convertMessages(openaiMessages []OpenAIMessage) ConvertMessagesResult {
 	}
 }
 
-// parseSSEResponse parses SSE response from Raycast into a single text
-func parseSSEResponse(responseText string) string {
-	scanner := bufio.NewScanner(strings.NewReader(responseText))
-	var fullText string
+// messageContentText extracts the text of a message's content, which may hold any JSON value.
+// It never fails, malformed content gives a best-effort result:
+//   - a string is used as-is, and null gives an empty string
+//   - an array's parts are concatenated in order
+//   - a part that is a string is used as text
+//   - a part object with type "text", or with no type but a "text" field, contributes its text
+//   - other part types, such as image_url, and parts of any other shape are skipped
+//   - a single part object instead of an array is treated as a one-part array
+//   - text that is not a string, such as a number, and a number or boolean content are JSON-encoded
+func messageContentText(content interface{}) string {
+	switch content := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return content
+	case []interface{}:
+		var text strings.Builder
+		for _, part := range content {
+			switch part := part.(type) {
+			case string:
+				text.WriteString(part)
+			case map[string]interface{}:
+				text.WriteString(contentPartText(part))
+			}
+		}
+		return text.String()
+	case map[string]interface{}:
+		return contentPartText(content)
+	case float64, bool:
+		return jsonText(content)
+	default:
+		return ""
+	}
+}
+
+// contentPartText returns the text of a content part object, or an empty string for non-text parts
+func contentPartText(part map[string]interface{}) string {
+	partType, hasType := part["type"]
+	if hasType && partType != "text" {
+		return ""
+	}
+
+	switch text := part["text"].(type) {
+	case nil:
+		return ""
+	case string:
+		return text
+	default:
+		return jsonText(text)
+	}
+}
+
+// jsonText encodes a decoded JSON value back to JSON text
+func jsonText(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// sendRaycastRequest sends a chat request to Raycast API and returns the raw response.
+// Rate-limited (429) responses are retried after their Retry-After delay, up to
+// config.MaxRetries times, as long as the delay does not exceed config.RetryAfterMax.
+// Cancelling ctx cancels the request, including a response still streaming. notify, if set,
+// receives the queue position while the request waits for a concurrency slot.
+func sendRaycastRequest(ctx context.Context, config Config, raycastRequest RaycastChatRequest, notify func(position int)) (*http.Response, error) {
+	requestBody, err := json.Marshal(raycastRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	log.Printf("Sending request to Raycast: %s", string(requestBody))
+
+	if resp, replayed, err := config.Fixtures.Replay(raycastRequest); replayed {
+		return resp, err
+	}
+
+	// The limiter is acquired first so that a half-open breaker's probe is never rejected for being busy
+	if !config.UpstreamLimiter.Acquire(ctx, notify) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrUpstreamBusy
+	}
+
+	if !config.CircuitBreaker.Allow() {
+		config.UpstreamLimiter.Release()
+		return nil, ErrCircuitOpen
+	}
+
+	// The deadline covers reading the response too, so it ends when the body is closed
+	var cancel context.CancelFunc
+	if config.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	ctx, span := config.Tracer.StartUpstreamSpan(ctx, "raycast.chat",
+		attribute.String("gen_ai.request.model", raycastRequest.Model),
+		attribute.String("raycast.provider", raycastRequest.Provider))
+	resp, err := postWithRetries(ctx, config, requestBody)
+	if err != nil {
+		span.RecordError(err)
+		endSpan(span, 0)
+		cancel()
+		config.UpstreamLimiter.Release()
+		return nil, err
+	}
+	endSpan(span, resp.StatusCode)
+	resp.Body = config.UpstreamLimiter.ReleaseOnClose(&cancelOnClose{ReadCloser: resp.Body, cancel: cancel})
+	config.Fixtures.Record(raycastRequest, resp)
+	return resp, nil
+}
+
+// sendWithFallbacks sends a chat request, trying the configured fallback models in turn while the upstream fails
+// with a server error or rejects the model as unavailable. raycastRequest is updated to the model that was tried last.
+// Rejections by the concurrency limit or the circuit breaker and cancelled requests are returned without falling back.
+func sendWithFallbacks(ctx context.Context, config Config, raycastRequest *RaycastChatRequest, body OpenAIChatRequest, models map[string]ModelCacheEntry, notify func(position int)) (*http.Response, error) {
+	resp, err := sendRaycastRequest(ctx, config, *raycastRequest, notify)
+
+	for _, fallback := range config.ModelFallbacks[raycastRequest.Model] {
+		if errors.Is(err, ErrUpstreamBusy) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+			break
+		}
+
+		var bodyBytes []byte
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+			bodyBytes, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 500 && !isModelUnavailableError(resp.StatusCode, bodyBytes) {
+				// Not worth falling back, hand the error back as it was
+				resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				break
+			}
+		}
+
+		provider, modelName, found := getProviderInfo(config, config.realModelID(fallback), models)
+		if !found {
+			log.Printf("Skipping unknown fallback model %s", fallback)
+			if err == nil {
+				resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			}
+			continue
+		}
+		log.Printf("Model %s failed, falling back to %s", raycastRequest.Model, modelName)
+
+		// Provider-specific parameters are reapplied for the fallback's provider
+		raycastRequest.Model, raycastRequest.Provider = modelName, provider
+		raycastRequest.LogitBias = providerLogitBias(provider, body.LogitBias)
+		raycastRequest.Logprobs, raycastRequest.TopLogprobs = false, nil
+		raycastRequest.ReasoningEffort, raycastRequest.Thinking = "", nil
+		applyProviderTweaks(provider, body, raycastRequest)
+
+		resp, err = sendRaycastRequest(ctx, config, *raycastRequest, notify)
+	}
+	return resp, err
+}
+
+// modelUnavailablePhrases identify upstream errors rejecting the requested model
+var modelUnavailablePhrases = []string{"model not found", "model_not_found", "does not exist", "not available", "unavailable", "unsupported model"}
+
+// isModelUnavailableError reports whether an upstream error response rejects the model itself
+func isModelUnavailableError(statusCode int, body []byte) bool {
+	if statusCode == http.StatusNotFound {
+		return true
+	}
+	if statusCode != http.StatusBadRequest {
+		return false
+	}
+	text := strings.ToLower(string(body))
+	for _, phrase := range modelUnavailablePhrases {
+		if strings.Contains(text, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelOnClose cancels the request context once the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the context
+func (cb *cancelOnClose) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// postWithRetries posts a request body to Raycast, retrying rate-limited responses
+func postWithRetries(ctx context.Context, config Config, requestBody []byte) (*http.Response, error) {
+	refreshed := false
+	for attempt := 0; ; {
+		resp, err := doWithFailover(ctx, config, config.HTTPClient, "POST", config.APIURLs, requestBody)
+		if errors.Is(err, context.Canceled) {
+			// The client went away, which says nothing about the upstream
+			config.CircuitBreaker.RecordCanceled()
+			return nil, err
+		}
+		if err != nil {
+			config.CircuitBreaker.RecordFailure()
+			return nil, err
+		}
+
+		log.Printf("Response status: %d", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			config.CircuitBreaker.RecordFailure()
+		} else {
+			config.CircuitBreaker.RecordSuccess()
+		}
+
+		// An expired token is refreshed once and the request retried with the new one
+		if resp.StatusCode == http.StatusUnauthorized && config.TokenRefresher != nil && !refreshed {
+			refreshed = true
+			staleToken := strings.TrimPrefix(resp.Request.Header.Get("Authorization"), "Bearer ")
+			if err := config.TokenRefresher.Refresh(config.ModelsClient, staleToken); err != nil {
+				log.Printf("Failed to refresh bearer token: %v", err)
+				return resp, nil
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			continue
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= config.MaxRetries {
+			return resp, nil
+		}
+
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if !ok || delay > config.RetryAfterMax {
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		attempt++
+		log.Printf("Rate limited by Raycast, retrying in %v (attempt %d of %d)", delay, attempt, config.MaxRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// doWithFailover sends a request with the Raycast headers to each URL in turn until one can be reached.
+// Only connection failures move on to the next URL, any HTTP response is returned as is.
+func doWithFailover(ctx context.Context, config Config, client *http.Client, method string, urls []string, body []byte) (*http.Response, error) {
+	lastErr := errors.New("no upstream URLs configured")
+	for i, url := range urls {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		for key, value := range getRaycastHeaders(config) {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err // Cancelled or timed out, the other URLs would fail the same way
+		}
+		lastErr = err
+		if i < len(urls)-1 {
+			log.Printf("Failed to reach %s, trying next upstream URL: %v", url, err)
+		}
+	}
+	return nil, lastErr
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if retryAt, err := http.ParseTime(value); err == nil {
+		delay := time.Until(retryAt)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// redactedRequestBody returns the JSON sent to Raycast with any secrets redacted
+func redactedRequestBody(config Config, raycastRequest RaycastChatRequest) string {
+	requestBody, err := json.Marshal(raycastRequest)
+	if err != nil {
+		return ""
+	}
+
+	return redactSecrets(config, string(requestBody))
+}
+
+// redactSecrets masks the Raycast token and API keys in text shown to clients
+func redactSecrets(config Config, text string) string {
+	if token := config.bearerToken(); token != "" {
+		text = strings.ReplaceAll(text, token, "[REDACTED]")
+	}
+	for _, key := range config.apiKeys() {
+		text = strings.ReplaceAll(text, key, "[REDACTED]")
+	}
+	return text
+}
+
+// upstreamErrorDetails describes a failed upstream response by its status and body,
+// truncated and with secrets redacted, so clients can tell auth, rate limit and server errors apart
+func upstreamErrorDetails(config Config, statusCode int, body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > UpstreamErrorBodyBytes {
+		text = text[:UpstreamErrorBodyBytes] + "...(truncated)"
+	}
+	return fmt.Sprintf("upstream status %d: %s", statusCode, redactSecrets(config, text))
+}
+
+// resolveMaxTokens unifies max_completion_tokens and the deprecated max_tokens into a single limit
+func resolveMaxTokens(body OpenAIChatRequest) int {
+	if body.MaxCompletionTokens > 0 {
+		return body.MaxCompletionTokens
+	}
+	return body.MaxTokens
+}
+
+// validateLogitBias checks that logit_bias keys are token IDs and values are within [-100, 100]
+func validateLogitBias(logitBias map[string]float64) error {
+	for token, bias := range logitBias {
+		if _, err := strconv.Atoi(token); err != nil {
+			return fmt.Errorf("logit_bias key %q is not a token ID", token)
+		}
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("logit_bias value %v for token %s must be between -100 and 100", bias, token)
+		}
+	}
+	return nil
+}
+
+// validateParams checks sampling parameters against the ranges OpenAI accepts
+func validateParams(body OpenAIChatRequest) error {
+	if body.Temperature != nil && (*body.Temperature < 0 || *body.Temperature > 2) {
+		return fmt.Errorf("'temperature' must be between 0 and 2, got %v", *body.Temperature)
+	}
+	if body.TopP != nil && (*body.TopP < 0 || *body.TopP > 1) {
+		return fmt.Errorf("'top_p' must be between 0 and 1, got %v", *body.TopP)
+	}
+	if body.PresencePenalty != nil && (*body.PresencePenalty < -2 || *body.PresencePenalty > 2) {
+		return fmt.Errorf("'presence_penalty' must be between -2 and 2, got %v", *body.PresencePenalty)
+	}
+	if body.FrequencyPenalty != nil && (*body.FrequencyPenalty < -2 || *body.FrequencyPenalty > 2) {
+		return fmt.Errorf("'frequency_penalty' must be between -2 and 2, got %v", *body.FrequencyPenalty)
+	}
+	if body.N != nil && *body.N < 1 {
+		return fmt.Errorf("'n' must be at least 1, got %d", *body.N)
+	}
+	if body.TopLogprobs != nil {
+		if *body.TopLogprobs < 0 || *body.TopLogprobs > 20 {
+			return fmt.Errorf("'top_logprobs' must be between 0 and 20, got %d", *body.TopLogprobs)
+		}
+		if !body.Logprobs {
+			return fmt.Errorf("'top_logprobs' requires 'logprobs' to be true")
+		}
+	}
+	return nil
+}
+
+// providerLogitBias returns the logit_bias to forward for a provider, or nil if it is unsupported
+func providerLogitBias(provider string, logitBias map[string]float64) map[string]float64 {
+	if len(logitBias) == 0 {
+		return nil
+	}
+	if !LogitBiasProviders[provider] {
+		log.Printf("Debug: Ignoring logit_bias, not supported by provider %s", provider)
+		return nil
+	}
+	return logitBias
+}
+
+// applyProviderTweaks forwards the provider-specific parameters a provider understands and drops the rest
+func applyProviderTweaks(provider string, body OpenAIChatRequest, raycastRequest *RaycastChatRequest) {
+	if body.Logprobs {
+		if LogprobsProviders[provider] {
+			raycastRequest.Logprobs = true
+			raycastRequest.TopLogprobs = body.TopLogprobs
+		} else {
+			log.Printf("Warning: Ignoring logprobs, not supported by provider %s", provider)
+		}
+	}
+
+	if body.ReasoningEffort != "" {
+		if ReasoningEffortProviders[provider] {
+			raycastRequest.ReasoningEffort = body.ReasoningEffort
+		} else {
+			log.Printf("Debug: Ignoring reasoning_effort, not supported by provider %s", provider)
+		}
+	}
+
+	if body.Thinking != nil {
+		if ThinkingProviders[provider] {
+			raycastRequest.Thinking = body.Thinking
+		} else {
+			log.Printf("Debug: Ignoring thinking, not supported by provider %s", provider)
+		}
+	}
+}
+
+// raycastTools translates the built-in tools requested by the client into Raycast tools
+func raycastTools(body OpenAIChatRequest) []RaycastTool {
+	webSearch := body.WebSearch
+	for _, tool := range body.Tools {
+		switch tool.Type {
+		case "web_search", "web_search_preview":
+			webSearch = true
+		}
+	}
+
+	tools := []RaycastTool{}
+	if webSearch {
+		tools = append(tools, RaycastTool{Name: "web_search", Type: "remote_tool"})
+	}
+	return tools
+}
+
+// citationAnnotations converts Raycast citations into OpenAI url_citation annotations
+func citationAnnotations(citations []RaycastCitation) []Annotation {
+	annotations := make([]Annotation, 0, len(citations))
+	for _, citation := range citations {
+		annotations = append(annotations, Annotation{
+			Type: "url_citation",
+			URLCitation: URLCitation{
+				URL:        citation.URL,
+				Title:      citation.Title,
+				StartIndex: citation.StartIndex,
+				EndIndex:   citation.EndIndex,
+			},
+		})
+	}
+	return annotations
+}
+
+// newDryRunResponse builds a canned Raycast SSE response that echoes the last user message
+func newDryRunResponse(messages []RaycastMessage) *http.Response {
+	var lastUserText string
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Author == "user" {
+			lastUserText = messages[i].Content.Text
+			break
+		}
+	}
+
+	var body bytes.Buffer
+	for _, data := range []RaycastSSEData{
+		{Text: lastUserText},
+		{FinishReason: "stop"},
+	} {
+		jsonData, _ := json.Marshal(data)
+		fmt.Fprintf(&body, "data: %s\n\n", string(jsonData))
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(&body),
+	}
+}
+
+// mapUpstreamStatus maps a non-200 Raycast status to the status returned to clients
+func mapUpstreamStatus(statusCode int) int {
+	// Upstream server errors become a bad gateway; client errors such as 401 and 429 pass through
+	if statusCode >= 500 {
+		return http.StatusBadGateway
+	}
+	return statusCode
+}
+
+// contextLengthPhrases identify upstream errors for prompts exceeding the model's context window
+var contextLengthPhrases = []string{"context length", "context_length", "context window", "prompt is too long", "too many tokens", "maximum context"}
+
+// isContextLengthError reports whether an upstream error response rejects the prompt as too long
+func isContextLengthError(statusCode int, body []byte) bool {
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusRequestEntityTooLarge {
+		return false
+	}
+	text := strings.ToLower(string(body))
+	for _, phrase := range contextLengthPhrases {
+		if strings.Contains(text, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextLengthMessage explains a context length error using the model's context window, when known
+func contextLengthMessage(modelId string, contextWindow int, promptTokens int) string {
+	if contextWindow <= 0 {
+		return fmt.Sprintf("The request to model '%s' exceeds its maximum context length (about %d tokens in the messages). Please reduce the length of the messages.", modelId, promptTokens)
+	}
+	return fmt.Sprintf("This model's maximum context length is %d tokens, but the messages are about %d tokens. Please reduce the length of the messages.", contextWindow, promptTokens)
+}
+
+// readSSEEvents reads SSE events line by line and calls handle with each event's type and data,
+// joining multi-line data with newlines as the SSE format specifies. Reading stops early when handle returns false.
+func readSSEEvents(body io.Reader, handle func(event string, data string) bool) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), MaxSSELineBytes)
+	event := ""
+	var dataLines []string
+
+	// dispatch delivers the buffered event, a blank line or the end of the body ends it
+	dispatch := func() bool {
+		if len(dataLines) == 0 {
+			event = ""
+			return true
+		}
+		ok := handle(event, strings.Join(dataLines, "\n"))
+		event, dataLines = "", nil
+		return ok
+	}
 
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSuffix(scanner.Text(), "\r")
 		if line == "" {
+			if !dispatch() {
+				return nil
+			}
 			continue
 		}
-		if strings.HasPrefix(line, "data:") {
-			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-			var jsonData RaycastSSEData
-			if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
-				log.Printf("Failed to parse SSE data: %v", err)
-				continue
-			}
-			if jsonData.Text != "" {
-				fullText += jsonData.Text
+		if strings.HasPrefix(line, ":") {
+			continue // Comment
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+// parseSSEResponse reads an SSE response from Raycast and assembles the text, reasoning, citations and last finish reason.
+// An "event: error" message is returned as an error.
+// Only the assembled text is kept in memory, never the raw response.
+func parseSSEResponse(body io.Reader) (string, string, string, []RaycastCitation, []TokenLogprob, error) {
+	var fullText strings.Builder
+	var reasoning strings.Builder
+	var finishReason string
+	var citations []RaycastCitation
+	var logprobs []TokenLogprob
+	var upstreamErr error
+
+	err := readSSEEvents(body, func(event string, data string) bool {
+		if event == "error" {
+			upstreamErr = fmt.Errorf("upstream error: %s", sseErrorMessage(data))
+			return false
+		}
+
+		var jsonData RaycastSSEData
+		if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
+			log.Printf("Failed to parse SSE data: %v", err)
+			return true
+		}
+		fullText.WriteString(jsonData.Text)
+		reasoning.WriteString(jsonData.Reasoning)
+		citations = append(citations, jsonData.Citations...)
+		logprobs = append(logprobs, jsonData.Logprobs...)
+		if jsonData.FinishReason != "" {
+			finishReason = jsonData.FinishReason
+		}
+		return true
+	})
+
+	if upstreamErr != nil {
+		return fullText.String(), reasoning.String(), "error", citations, logprobs, upstreamErr
+	}
+	return fullText.String(), reasoning.String(), finishReason, citations, logprobs, err
+}
+
+// sseErrorMessage extracts the message from the data of an SSE error event, falling back to the raw data
+func sseErrorMessage(data string) string {
+	var payload struct {
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err == nil {
+		if payload.Error.Message != "" {
+			return payload.Error.Message
+		}
+		if payload.Message != "" {
+			return payload.Message
+		}
+	}
+	return data
+}
+
+// flattenMessages collapses a conversation into a single user message with role-prefixed turns,
+// for providers that mishandle multi-turn conversations through Raycast
+func flattenMessages(messageResult *ConvertMessagesResult) {
+	if len(messageResult.RaycastMessages) < 2 {
+		return
+	}
+
+	turns := make([]string, 0, len(messageResult.RaycastMessages))
+	for _, msg := range messageResult.RaycastMessages {
+		role := "User"
+		if msg.Author == "assistant" {
+			role = "Assistant"
+		}
+		turns = append(turns, role+": "+msg.Content.Text)
+	}
+
+	messageResult.RaycastMessages = []RaycastMessage{
+		{
+			Author: "user",
+			Content: struct {
+				Text string `json:"text"`
+			}{Text: strings.Join(turns, "\n\n")},
+		},
+	}
+}
+
+// estimateTokens roughly estimates the number of tokens in a text (about 4 characters per token)
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// trimMessages drops the oldest messages until the prompt fits within budget tokens.
+// The system instruction and the latest message are always kept. Returns the number of dropped messages.
+func trimMessages(messageResult *ConvertMessagesResult, budget int, tokenizer Tokenizer) int {
+	trimmed := 0
+	for len(messageResult.RaycastMessages) > 1 && tokenizer.CountPrompt(*messageResult) > budget {
+		messageResult.RaycastMessages = messageResult.RaycastMessages[1:]
+		trimmed++
+	}
+	return trimmed
+}
+
+// continueTruncatedResponse issues follow-up requests while Raycast stops on the length limit.
+// Each follow-up carries the partial output as assistant context, up to config.MaxContinuations times.
+func continueTruncatedResponse(ctx context.Context, config Config, raycastRequest RaycastChatRequest, fullText string, finishReason string) (string, string) {
+	baseMessages := raycastRequest.Messages
+	maxTokens := raycastRequest.MaxTokens
+
+	// Providers report the length limit as either "length" or "max_tokens"
+	for i := 0; i < config.MaxContinuations && mapFinishReason(finishReason) == "length"; i++ {
+		// Stop once the client's requested limit has been reached
+		if maxTokens > 0 {
+			remaining := maxTokens - config.Tokenizer.Count(fullText)
+			if remaining <= 0 {
+				break
 			}
+			raycastRequest.MaxTokens = remaining
 		}
+
+		raycastRequest.Messages = append(append([]RaycastMessage{}, baseMessages...),
+			RaycastMessage{
+				Author: "assistant",
+				Content: struct {
+					Text string `json:"text"`
+				}{Text: fullText},
+			},
+			RaycastMessage{
+				Author: "user",
+				Content: struct {
+					Text string `json:"text"`
+				}{Text: ContinuationPrompt},
+			},
+		)
+
+		resp, err := sendRaycastRequest(ctx, config, raycastRequest, nil)
+		if err != nil {
+			log.Printf("Error sending continuation request: %v", err)
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("Continuation request failed with status %d", resp.StatusCode)
+			break
+		}
+		text, _, reason, _, _, err := parseSSEResponse(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Error reading continuation response: %v", err)
+			break
+		}
+
+		log.Printf("Continuation %d added %d characters, finish reason: %s", i+1, len(text), reason)
+		fullText += text
+		finishReason = reason
 	}
 
-	return fullText
+	return fullText, finishReason
+}
+
+// pumpSSEEvents reads SSE events from Raycast and sends them to the events channel.
+// The channel is bounded, so a slow client applies backpressure to upstream reads.
+// A read error other than EOF is sent as a final event with finish reason "error".
+// When done is closed, the upstream body is closed, which cancels the upstream request.
+func pumpSSEEvents(body io.ReadCloser, events chan<- RaycastSSEData, done <-chan struct{}) {
+	defer close(events)
+
+	stopped := false
+	err := readSSEEvents(body, func(event string, data string) bool {
+		var jsonData RaycastSSEData
+		if event == "error" {
+			log.Printf("Upstream error event: %s", sseErrorMessage(data))
+			jsonData.FinishReason = "error"
+		} else if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
+			log.Printf("Failed to parse SSE data: %v", err)
+			return true
+		}
+
+		select {
+		case events <- jsonData:
+			return true
+		case <-done:
+			stopped = true
+			return false
+		}
+	})
+
+	if stopped {
+		body.Close()
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading from response: %v", err)
+		// Report the failure so the client can tell it apart from a complete response
+		select {
+		case events <- RaycastSSEData{FinishReason: "error"}:
+		case <-done:
+		}
+	}
 }
 
-// handleStreamingResponse handles streaming response from Raycast
-func handleStreamingResponse(c *gin.Context, response *http.Response, modelId string) {
+// handleStreamingResponse handles streaming response from Raycast and returns the streamed text and finish reason
+func handleStreamingResponse(c *gin.Context, response *http.Response, modelId string, config Config, includeReasoning bool) (string, string) {
+	// Read upstream in a separate goroutine so slow clients don't stall Raycast
+	events := make(chan RaycastSSEData, StreamBufferSize)
+	done := make(chan struct{})
+	go pumpSSEEvents(response.Body, events, done)
+
+	return streamEvents(c, events, done, modelId, config, includeReasoning)
+}
+
+// streamEvents writes Raycast events to the client as OpenAI streaming chunks and returns the assembled text and finish reason.
+// When the client disconnects or stops reading, done is closed and the remaining events are drained,
+// so the source must stop and close events once done is closed.
+func streamEvents(c *gin.Context, events <-chan RaycastSSEData, done chan struct{}, modelId string, config Config, includeReasoning bool) (string, string) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Status(http.StatusOK)
 
 	// Set up a flush interval for the writer
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
+	if _, ok := c.Writer.(http.Flusher); !ok {
 		log.Println("Streaming unsupported")
 		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		close(done)
+		return "", ""
 	}
 
-	reader := bufio.NewReader(response.Body)
-	buffer := ""
+	// A client that stops reading without closing the connection would block writes forever, so each
+	// write gets a deadline. Missing it breaks the connection and the stream is aborted like a disconnect.
+	controller := http.NewResponseController(c.Writer)
+	defer controller.SetWriteDeadline(time.Time{})
+	stalled := false
+	write := func(text string) {
+		if stalled {
+			return
+		}
+		if config.StreamWriteTimeout > 0 {
+			if err := controller.SetWriteDeadline(time.Now().Add(config.StreamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				log.Printf("Error setting write deadline: %v", err)
+			}
+		}
+		_, err := io.WriteString(c.Writer, text)
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			log.Printf("Error writing to client, aborting stream: %v", err)
+			stalled = true
+		}
+	}
 
-	for {
-		line, err := reader.ReadString('\n')
+	// Confirm the stream is live before waiting on the first upstream token
+	write(": connected\n\n")
+
+	// The ID and creation time are shared by every chunk of this completion
+	responseId := fmt.Sprintf("chatcmpl-%s", uuid.New().String())
+	created := time.Now().Unix()
+
+	// Send keepalive comments while waiting for upstream data so idle proxies keep the connection open
+	var ticker *time.Ticker
+	var keepalive <-chan time.Time
+	if config.KeepaliveInterval > 0 {
+		ticker = time.NewTicker(config.KeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// sendChunk writes an OpenAI-compatible streaming chunk to the client
+	sendChunk := func(delta OpenAIChunkDelta, finishReason *string) {
+		chunkData, err := json.Marshal(OpenAIChatChunk{
+			ID:      responseId,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   modelId,
+			Choices: []OpenAIChunkChoice{
+				{
+					Index:        0,
+					Delta:        delta,
+					FinishReason: finishReason,
+				},
+			},
+			Provider: c.GetString(providerKey),
+		})
 		if err != nil {
-			if err == io.EOF {
-				break
+			log.Printf("Error marshaling chunk: %v", err)
+			return
+		}
+
+		// Send the chunk
+		write("data: " + string(chunkData) + "\n\n")
+
+		// Data just went out, so restart the idle timer
+		if ticker != nil {
+			ticker.Reset(config.KeepaliveInterval)
+		}
+	}
+
+	// With coalescing enabled, text is held back briefly and sent as fewer, larger chunks
+	var pending strings.Builder
+	var coalesceTimer *time.Timer
+	var coalesceDone <-chan time.Time
+	flushPending := func() {
+		if coalesceTimer != nil {
+			coalesceTimer.Stop()
+			coalesceTimer, coalesceDone = nil, nil
+		}
+		if pending.Len() > 0 {
+			sendChunk(OpenAIChunkDelta{Content: pending.String()}, nil)
+			pending.Reset()
+		}
+	}
+
+	var fullText strings.Builder
+	finishReason := ""
+
+	for {
+		if stalled {
+			close(done)
+			for range events {
 			}
-			log.Printf("Error reading from response: %v", err)
-			break
+			return fullText.String(), ""
 		}
 
-		buffer += line
+		select {
+		case <-coalesceDone:
+			flushPending()
+		case <-keepalive:
+			write(": keepalive\n\n")
+		case jsonData, ok := <-events:
+			if !ok {
+				flushPending()
 
-		// Process complete SSE messages in the buffer
-		if strings.HasSuffix(buffer, "\n\n") {
-			lines := strings.Split(buffer, "\n")
-			buffer = ""
+				// Always end with an empty delta carrying the finish reason
+				mappedReason := mapFinishReason(finishReason)
+				sendChunk(OpenAIChunkDelta{}, &mappedReason)
 
-			for _, l := range lines {
-				if strings.TrimSpace(l) == "" {
+				// Send final [DONE] marker
+				write("data: [DONE]\n\n")
+				return fullText.String(), mappedReason
+			}
+
+			if jsonData.FinishReason != "" {
+				finishReason = jsonData.FinishReason
+			}
+			if includeReasoning && jsonData.Reasoning != "" {
+				flushPending()
+				sendChunk(OpenAIChunkDelta{ReasoningContent: jsonData.Reasoning}, nil)
+			}
+			if len(jsonData.Citations) > 0 {
+				flushPending()
+				sendChunk(OpenAIChunkDelta{Annotations: citationAnnotations(jsonData.Citations)}, nil)
+			}
+			if jsonData.Text != "" {
+				fullText.WriteString(jsonData.Text)
+				if config.CoalesceInterval <= 0 {
+					sendChunk(OpenAIChunkDelta{Content: jsonData.Text}, nil)
 					continue
 				}
 
-				if strings.HasPrefix(l, "data:") {
-					data := strings.TrimSpace(strings.TrimPrefix(l, "data:"))
-					var jsonData RaycastSSEData
-					if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
-						log.Printf("Failed to parse SSE data: %v", err)
-						continue
-					}
-
-					// Create OpenAI-compatible streaming chunk
-					chunk := struct {
-						ID      string `json:"id"`
-						Object  string `json:"object"`
-						Created int64  `json:"created"`
-						Model   string `json:"model"`
-						Choices []struct {
-							Index int `json:"index"`
-							Delta struct {
-								Content string `json:"content"`
-							} `json:"delta"`
-							FinishReason string `json:"finish_reason"`
-						} `json:"choices"`
-					}{
-						ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelId,
-						Choices: []struct {
-							Index int `json:"index"`
-							Delta struct {
-								Content string `json:"content"`
-							} `json:"delta"`
-							FinishReason string `json:"finish_reason"`
-						}{
-							{
-								Index: 0,
-								Delta: struct {
-									Content string `json:"content"`
-								}{
-									Content: jsonData.Text,
-								},
-								FinishReason: jsonData.FinishReason,
-							},
-						},
-					}
-
-					chunkData, err := json.Marshal(chunk)
-					if err != nil {
-						log.Printf("Error marshaling chunk: %v", err)
-						continue
-					}
-
-					// Send the chunk
-					fmt.Fprintf(c.Writer, "data: %s\n\n", string(chunkData))
-					flusher.Flush()
+				pending.WriteString(jsonData.Text)
+				if pending.Len() >= CoalesceMaxBytes {
+					flushPending()
+				} else if coalesceTimer == nil {
+					coalesceTimer = time.NewTimer(config.CoalesceInterval)
+					coalesceDone = coalesceTimer.C
 				}
 			}
+		case <-c.Request.Context().Done():
+			log.Println("Client disconnected, closing upstream response")
+			close(done)
+			for range events {
+			}
+			return fullText.String(), ""
 		}
 	}
+}
 
-	// Send final [DONE] marker
-	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-	flusher.Flush()
+// mapFinishReason maps Raycast finish reason to OpenAI finish reason, defaulting to "stop"
+func mapFinishReason(finishReason string) string {
+	switch finishReason {
+	case "", "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "safety", "refusal", "content_filtered":
+		return "content_filter"
+	default:
+		return finishReason
+	}
 }
 
-// handleNonStreamingResponse handles non-streaming response from Raycast
-func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId string) {
-	// Collect the entire response
-	bodyBytes, err := io.ReadAll(response.Body)
+// handleNonStreamingResponse handles non-streaming response from Raycast and returns the assembled text and finish reason.
+// When raycastRequest is set, output truncated by the length limit is continued with follow-up requests.
+// Complete answers are stored in the response cache under cacheKey unless it is empty.
+func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId string, config Config, raycastRequest *RaycastChatRequest, body OpenAIChatRequest, cacheKey string, promptTokens int) (string, string) {
+	readStart := time.Now()
+
+	// Parse the SSE stream as it arrives rather than buffering the raw response
+	fullText, reasoning, finishReason, citations, tokenLogprobs, err := parseSSEResponse(response.Body)
+	// Free the connection and concurrency slot before any continuation requests
+	response.Body.Close()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Error: struct {
@@ -247,14 +1072,174 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 				Details: err.Error(),
 			},
 		})
-		return
+		return "", ""
+	}
+
+	log.Printf("Received %d characters, finish reason: %s", len(fullText), finishReason)
+
+	reasoned := reasoning != ""
+	if !body.IncludeReasoning {
+		reasoning = ""
+	}
+
+	// Logprobs stay null when not requested or not returned by the provider
+	var logprobs *ChoiceLogprobs
+	if body.Logprobs && len(tokenLogprobs) > 0 {
+		logprobs = &ChoiceLogprobs{Content: tokenLogprobs}
+	}
+
+	if raycastRequest != nil {
+		continued, reason := continueTruncatedResponse(c.Request.Context(), config, *raycastRequest, fullText, finishReason)
+		if continued != fullText {
+			logprobs = nil // Continuations don't carry logprobs, so they would be incomplete
+		}
+		fullText, finishReason = continued, reason
+	}
+	c.Set(timingUpstream, c.GetDuration(timingUpstream)+time.Since(readStart))
+
+	fingerprint := config.SystemFingerprint
+	if raycastRequest != nil {
+		fingerprint = systemFingerprint(config.SystemFingerprint, modelId, raycastRequest.Seed)
+	}
+
+	// An empty completion that did not finish normally was most likely blocked upstream. Reporting it as a
+	// length cut would have clients raise max_tokens for an answer that was never coming, so that is only
+	// kept when the model spent its tokens reasoning.
+	mappedReason := mapFinishReason(finishReason)
+	if fullText == "" && mappedReason != "stop" && (mappedReason != "length" || !reasoned) {
+		mappedReason = "content_filter"
+	}
+
+	// Close whatever a length cut left open in JSON mode, the finish reason still tells the client it was truncated
+	jsonMode := body.ResponseFormat != nil && body.ResponseFormat.Type != "text"
+	if jsonMode && mappedReason == "length" && !json.Valid([]byte(fullText)) {
+		if repaired, ok := repairJSON(fullText); ok {
+			log.Println("Repaired truncated JSON response")
+			fullText = repaired
+		}
+	}
+
+	// Validate structured outputs against the requested schema, giving the model one more try
+	if raycastRequest != nil && schemaInstruction(body.ResponseFormat) != "" && mappedReason == "stop" {
+		validated, err := validateSchemaResponse(fullText, body.ResponseFormat)
+		if err != nil {
+			log.Printf("Response did not match the JSON schema, retrying: %v", err)
+			validated, finishReason, err = retrySchemaResponse(c.Request.Context(), config, *raycastRequest, body.ResponseFormat, fullText, err)
+			mappedReason = mapFinishReason(finishReason)
+			logprobs = nil // They belonged to the rejected response
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, ErrorResponse{
+				Error: struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Details string `json:"details,omitempty"`
+				}{
+					Message: "Response did not match the requested JSON schema",
+					Type:    "server_error",
+					Details: err.Error(),
+				},
+			})
+			return "", ""
+		}
+		fullText = validated
+	}
+
+	annotations := citationAnnotations(citations)
+	writeChatCompletion(c, fullText, reasoning, annotations, logprobs, mappedReason, modelId, fingerprint, promptTokens, config)
+
+	// A truncated or filtered answer would later be served as a complete one, so only finished answers are cached
+	if cacheKey != "" && fullText != "" && mappedReason == "stop" {
+		config.ResponseCache.Set(cacheKey, CachedCompletion{
+			Text:         fullText,
+			Reasoning:    reasoning,
+			Annotations:  annotations,
+			FinishReason: mappedReason,
+		})
+	}
+	return fullText, mappedReason
+}
+
+// repairJSON closes the strings, objects and arrays left open by truncated JSON.
+// It returns the text unchanged and false when the result still isn't valid JSON.
+func repairJSON(text string) (string, bool) {
+	var open []byte
+	inString, escaped := false, false
+
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			inString = true
+		case '{':
+			open = append(open, '}')
+		case '[':
+			open = append(open, ']')
+		case '}', ']':
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+
+	repaired := text
+	if inString {
+		if escaped {
+			repaired = repaired[:len(repaired)-1]
+		}
+		repaired += `"`
+	}
+
+	// A dangling key needs a value and a dangling comma has to go
+	repaired = strings.TrimRight(repaired, " \t\r\n")
+	if strings.HasSuffix(repaired, ":") {
+		repaired += "null"
+	}
+	repaired = strings.TrimSuffix(repaired, ",")
+
+	for i := len(open) - 1; i >= 0; i-- {
+		repaired += string(open[i])
 	}
 
-	responseText := string(bodyBytes)
-	log.Printf("Raw response: %s", responseText)
+	if !json.Valid([]byte(repaired)) {
+		return text, false
+	}
+	return repaired, true
+}
+
+// versionFingerprint derives the default system fingerprint from the build version
+func versionFingerprint() string {
+	hash := sha256.Sum256([]byte(Version))
+	return "fp_" + hex.EncodeToString(hash[:])[:10]
+}
+
+// systemFingerprint returns the configured fingerprint, varied by model and seed when a seed is given
+func systemFingerprint(base string, modelId string, seed *int64) string {
+	if seed == nil {
+		return base
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", base, modelId, *seed)))
+	return "fp_" + hex.EncodeToString(hash[:])[:10]
+}
 
-	// Parse the SSE format to extract the full text
-	fullText := parseSSEResponse(responseText)
+// writeChatCompletion writes a complete, non-streaming chat completion in OpenAI format
+func writeChatCompletion(c *gin.Context, fullText string, reasoning string, annotations []Annotation, logprobs *ChoiceLogprobs, finishReason string, modelId string, fingerprint string, promptTokens int, config Config) {
+	reasoningTokens := config.Tokenizer.Count(reasoning)
+	completionTokens := config.Tokenizer.Count(fullText) + reasoningTokens
+
+	serializeStart := time.Now()
 
 	// Convert to OpenAI format
 	openaiResponse := OpenAIChatResponse{
@@ -265,29 +1250,32 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 		Choices: []struct {
 			Index   int `json:"index"`
 			Message struct {
-				Role        string   `json:"role"`
-				Content     string   `json:"content"`
-				Refusal     *string  `json:"refusal"`
-				Annotations []string `json:"annotations"`
+				Role             string       `json:"role"`
+				Content          string       `json:"content"`
+				ReasoningContent string       `json:"reasoning_content,omitempty"`
+				Refusal          *string      `json:"refusal"`
+				Annotations      []Annotation `json:"annotations"`
 			} `json:"message"`
-			Logprobs     *string `json:"logprobs"`
-			FinishReason string  `json:"finish_reason"`
+			Logprobs     *ChoiceLogprobs `json:"logprobs"`
+			FinishReason string          `json:"finish_reason"`
 		}{
 			{
 				Index: 0,
 				Message: struct {
-					Role        string   `json:"role"`
-					Content     string   `json:"content"`
-					Refusal     *string  `json:"refusal"`
-					Annotations []string `json:"annotations"`
+					Role             string       `json:"role"`
+					Content          string       `json:"content"`
+					ReasoningContent string       `json:"reasoning_content,omitempty"`
+					Refusal          *string      `json:"refusal"`
+					Annotations      []Annotation `json:"annotations"`
 				}{
-					Role:        "assistant",
-					Content:     fullText,
-					Refusal:     nil,
-					Annotations: []string{},
+					Role:             "assistant",
+					Content:          fullText,
+					ReasoningContent: reasoning,
+					Refusal:          nil,
+					Annotations:      annotations,
 				},
-				Logprobs:     nil,
-				FinishReason: "length",
+				Logprobs:     logprobs,
+				FinishReason: finishReason,
 			},
 		},
 		Usage: struct {
@@ -305,9 +1293,9 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 				RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
 			} `json:"completion_tokens_details"`
 		}{
-			PromptTokens:     10,
-			CompletionTokens: 10,
-			TotalTokens:      20,
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
 			PromptTokensDetails: struct {
 				CachedTokens int `json:"cached_tokens"`
 				AudioTokens  int `json:"audio_tokens"`
@@ -321,14 +1309,15 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 				AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
 				RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
 			}{
-				ReasoningTokens:          0,
+				ReasoningTokens:          reasoningTokens,
 				AudioTokens:              0,
 				AcceptedPredictionTokens: 0,
 				RejectedPredictionTokens: 0,
 			},
 		},
 		ServiceTier:       "default",
-		SystemFingerprint: "fp_b376dfbbd5",
+		Provider:          c.GetString(providerKey),
+		SystemFingerprint: fingerprint,
 	}
 
 	jsonData, err := json.MarshalIndent(openaiResponse, "", "  ")
@@ -349,7 +1338,294 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 
 	// Add a newline to the end of the JSON data
 	jsonData = append(jsonData, '\n')
+
+	if config.Debug {
+		c.Header("Server-Timing", serverTiming(c, time.Since(serializeStart)))
+	}
+
 	// Set content type and write the formatted JSON
 	c.Header("Content-Type", "application/json")
+
+	// Compress large completions for clients that accept gzip or deflate
+	if config.EnableCompression {
+		c.Header("Vary", "Accept-Encoding")
+		switch encoding := responseEncoding(c.GetHeader("Accept-Encoding")); encoding {
+		case "gzip":
+			c.Header("Content-Encoding", encoding)
+			gzipWriter := gzip.NewWriter(c.Writer)
+			defer gzipWriter.Close()
+			gzipWriter.Write(jsonData)
+			return
+		case "deflate":
+			// The deflate content coding is the zlib format, not a raw deflate stream
+			c.Header("Content-Encoding", encoding)
+			zlibWriter := zlib.NewWriter(c.Writer)
+			defer zlibWriter.Close()
+			zlibWriter.Write(jsonData)
+			return
+		}
+	}
+
 	c.Writer.Write(jsonData)
 }
+
+// responseEncoding picks the content coding for a response from an Accept-Encoding header:
+// "gzip" or "deflate" when the client allows it, preferring gzip, or "" for none.
+// A coding is allowed when it is listed (x-gzip is an alias of gzip), or matched by "*", with a q-value above 0.
+func responseEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0 // An unreadable q-value is not consent
+			}
+			quality = parsed
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if current, ok := qualities[name]; !ok || quality > current {
+			qualities[name] = quality
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		quality, listed := qualities[encoding]
+		if !listed {
+			quality = qualities["*"]
+		}
+		if quality > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// toolResultText labels the output of a tool or function call so the model can tell it apart from user input
+func toolResultText(msg OpenAIMessage, contentText string) string {
+	label := msg.Name
+	if label == "" {
+		label = msg.ToolCallID
+	}
+	if label == "" {
+		return "Tool result:\n" + contentText
+	}
+	return fmt.Sprintf("Tool result (%s):\n%s", label, contentText)
+}
+
+// convertAnthropicMessages converts Anthropic messages format to OpenAI format
+func convertAnthropicMessages(body AnthropicMessagesRequest) []OpenAIMessage {
+	var openaiMessages []OpenAIMessage
+
+	// Anthropic keeps the system prompt outside of the messages array
+	if body.System != nil {
+		openaiMessages = append(openaiMessages, OpenAIMessage{
+			Role:    "system",
+			Content: body.System,
+		})
+	}
+
+	// Content blocks share the same text shape as OpenAI content parts
+	for _, msg := range body.Messages {
+		openaiMessages = append(openaiMessages, OpenAIMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+
+	return openaiMessages
+}
+
+// serverTiming builds a Server-Timing header from the phase durations recorded on the request context
+func serverTiming(c *gin.Context, serialize time.Duration) string {
+	metrics := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"auth", c.GetDuration(timingAuth)},
+		{"convert", c.GetDuration(timingConvert)},
+		{"upstream", c.GetDuration(timingUpstream)},
+		{"serialize", serialize},
+	}
+
+	parts := make([]string, len(metrics))
+	for i, metric := range metrics {
+		parts[i] = fmt.Sprintf("%s;dur=%.3f", metric.name, float64(metric.duration.Microseconds())/1000)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mapAnthropicStopReason maps Raycast finish reason to Anthropic stop reason, by way of the OpenAI finish reason
+func mapAnthropicStopReason(finishReason string) string {
+	switch mapFinishReason(finishReason) {
+	case "length":
+		return "max_tokens"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// writeAnthropicEvent writes a single SSE event in Anthropic format
+func writeAnthropicEvent(c *gin.Context, flusher http.Flusher, event string, data interface{}) {
+	eventData, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error marshaling event: %v", err)
+		return
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, string(eventData))
+	flusher.Flush()
+}
+
+// handleAnthropicStreamingResponse handles streaming response from Raycast in Anthropic format
+// and returns the streamed text and finish reason
+func handleAnthropicStreamingResponse(c *gin.Context, response *http.Response, modelId string, config Config, promptTokens int) (string, string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		log.Println("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", ""
+	}
+
+	writeAnthropicEvent(c, flusher, "message_start", gin.H{
+		"type": "message_start",
+		"message": gin.H{
+			"id":            fmt.Sprintf("msg_%s", uuid.New().String()),
+			"type":          "message",
+			"role":          "assistant",
+			"model":         modelId,
+			"content":       []AnthropicContentBlock{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         gin.H{"input_tokens": promptTokens, "output_tokens": 0},
+		},
+	})
+	writeAnthropicEvent(c, flusher, "content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         0,
+		"content_block": AnthropicContentBlock{Type: "text", Text: ""},
+	})
+
+	var fullText strings.Builder
+	finishReason := ""
+	errorMessage := ""
+
+	err := readSSEEvents(response.Body, func(event string, data string) bool {
+		if event == "error" {
+			errorMessage = sseErrorMessage(data)
+			return false
+		}
+
+		var jsonData RaycastSSEData
+		if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
+			log.Printf("Failed to parse SSE data: %v", err)
+			return true
+		}
+
+		if jsonData.FinishReason != "" {
+			finishReason = jsonData.FinishReason
+		}
+		if jsonData.Text == "" {
+			return true
+		}
+		fullText.WriteString(jsonData.Text)
+
+		writeAnthropicEvent(c, flusher, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": gin.H{"type": "text_delta", "text": jsonData.Text},
+		})
+		return true
+	})
+	if err != nil {
+		log.Printf("Error reading from response: %v", err)
+		errorMessage = err.Error()
+	}
+
+	// Anthropic streams report failures with an error event instead of a stop reason
+	if errorMessage != "" {
+		log.Printf("Upstream error event: %s", errorMessage)
+		writeAnthropicEvent(c, flusher, "error", gin.H{
+			"type":  "error",
+			"error": gin.H{"type": "api_error", "message": errorMessage},
+		})
+		return fullText.String(), "error"
+	}
+
+	writeAnthropicEvent(c, flusher, "content_block_stop", gin.H{
+		"type":  "content_block_stop",
+		"index": 0,
+	})
+	writeAnthropicEvent(c, flusher, "message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": mapAnthropicStopReason(finishReason), "stop_sequence": nil},
+		"usage": gin.H{"output_tokens": config.Tokenizer.Count(fullText.String())},
+	})
+	writeAnthropicEvent(c, flusher, "message_stop", gin.H{"type": "message_stop"})
+	return fullText.String(), mapFinishReason(finishReason)
+}
+
+// handleAnthropicNonStreamingResponse handles non-streaming response from Raycast in Anthropic format
+// and returns the assembled text and finish reason
+func handleAnthropicNonStreamingResponse(c *gin.Context, response *http.Response, modelId string, config Config, promptTokens int) (string, string) {
+	fullText, _, finishReason, _, _, err := parseSSEResponse(response.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AnthropicErrorResponse{
+			Type: "error",
+			Error: struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}{
+				Type:    "api_error",
+				Message: fmt.Sprintf("Error reading response body: %v", err),
+			},
+		})
+		return "", ""
+	}
+
+	anthropicResponse := AnthropicMessagesResponse{
+		ID:         fmt.Sprintf("msg_%s", uuid.New().String()),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      modelId,
+		Content:    []AnthropicContentBlock{{Type: "text", Text: fullText}},
+		StopReason: mapAnthropicStopReason(finishReason),
+	}
+	anthropicResponse.Usage.InputTokens = promptTokens
+	anthropicResponse.Usage.OutputTokens = config.Tokenizer.Count(fullText)
+
+	c.JSON(http.StatusOK, anthropicResponse)
+	return fullText, mapFinishReason(finishReason)
+}
+
+// listETag returns a strong ETag for a response body
+func listETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches an ETag, comparing weakly as RFC 9110 requires
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
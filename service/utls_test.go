@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestConvertMessagesMalformed(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    string
+		instruction string
+		texts       []string
+	}{
+		{"missing role", `[{"content":"Hi"},{"role":"user","content":"Hello"}]`, "default", []string{"Hello"}},
+		{"unknown role", `[{"role":"developer","content":"Hi"}]`, "default", nil},
+		{"late system message", `[{"role":"user","content":"Hi"},{"role":"system","content":"Be brief"}]`, "default", []string{"Hi"}},
+		{"system without text", `[{"role":"system","content":[{"type":"image_url"}]}]`, "default", nil},
+		{"null content", `[{"role":"user","content":null}]`, "default", []string{""}},
+		{"string parts", `[{"role":"user","content":["Hello, ","world"]}]`, "default", []string{"Hello, world"}},
+		{"number text", `[{"role":"user","content":[{"type":"text","text":42}]}]`, "default", []string{"42"}},
+		{"single part object", `[{"role":"user","content":{"type":"text","text":"Hi"}}]`, "default", []string{"Hi"}},
+		{"number content", `[{"role":"user","content":1.5}]`, "default", []string{"1.5"}},
+		{"mixed parts", `[{"role":"user","content":[1,null,{"type":"image_url"},{"text":"Hi"}]}]`, "default", []string{"Hi"}},
+		{"unlabelled tool result", `[{"role":"tool","content":"42"}]`, "default", []string{"Tool result:\n42"}},
+		{"system array", `[{"role":"system","content":[{"type":"text","text":"Be brief"}]}]`, "Be brief", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages []OpenAIMessage
+			if err := json.Unmarshal([]byte(tt.messages), &messages); err != nil {
+				t.Fatal(err)
+			}
+			result := convertMessages(messages, "default")
+
+			if result.SystemInstruction != tt.instruction {
+				t.Errorf("expected system instruction %q, got %q", tt.instruction, result.SystemInstruction)
+			}
+			var texts []string
+			for _, message := range result.RaycastMessages {
+				texts = append(texts, message.Content.Text)
+			}
+			if strings.Join(texts, "|") != strings.Join(tt.texts, "|") || len(texts) != len(tt.texts) {
+				t.Errorf("expected messages %q, got %q", tt.texts, texts)
+			}
+		})
+	}
+}
+
+func FuzzConvertMessages(f *testing.F) {
+	f.Add(`[{"role":"system","content":"Be brief"},{"role":"user","content":"Hi"}]`)
+	f.Add(`[{"role":"user","content":[{"type":"text","text":"Hi"},{"type":"image_url","image_url":{"url":"x"}}]}]`)
+	f.Add(`[{"role":"user","content":["a",1,true,null,{"text":{"nested":[1]}}]}]`)
+	f.Add(`[{"role":"tool","tool_call_id":"call_1","content":{"type":"text","text":7}}]`)
+	f.Add(`[{"role":"assistant","name":"bot","content":false}]`)
+
+	f.Fuzz(func(t *testing.T, data string) {
+		var messages []OpenAIMessage
+		if err := json.Unmarshal([]byte(data), &messages); err != nil {
+			t.Skip()
+		}
+
+		result := convertMessages(messages, "default")
+		if len(result.RaycastMessages) > len(messages) {
+			t.Fatalf("%d messages became %d", len(messages), len(result.RaycastMessages))
+		}
+		for _, message := range result.RaycastMessages {
+			if message.Author != "user" && message.Author != "assistant" {
+				t.Fatalf("unexpected author %q", message.Author)
+			}
+		}
+	})
+}
+
+func TestResponseEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"deflate, gzip;q=1.0, *;q=0.5", "gzip"},
+		{"br, deflate", "deflate"},
+		{"br", ""},
+		{"gzip;q=0", ""},
+		{"gzip; q=0.000", ""},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0, x-gzip;q=0.5", "gzip"},
+		{"gzip;q=oops", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"gzip;q=0, deflate;q=0, *", ""},
+		{"identity;q=1, *;q=0.1", "gzip"},
+		{"gzipped", ""},
+	}
+	for _, tt := range tests {
+		if got := responseEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("responseEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}